@@ -4,7 +4,6 @@ import (
 	"context"
 	"fmt"
 	"net"
-	"net/url"
 	"os/exec"
 	"strings"
 	"sync"
@@ -14,14 +13,14 @@ import (
 	selfContainerd "github.com/deepfence/vessel/containerd"
 	"github.com/deepfence/vessel/crio"
 	"github.com/deepfence/vessel/docker"
+	"github.com/deepfence/vessel/errdefs"
 	selfPodman "github.com/deepfence/vessel/podman"
+	"github.com/deepfence/vessel/types"
 	"github.com/deepfence/vessel/utils"
 	containerTypes "github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/client"
 	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
-	"google.golang.org/grpc"
-	"google.golang.org/grpc/credentials/insecure"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
 )
 
 func init() {
@@ -33,291 +32,395 @@ func init() {
 
 // GetAddressAndDialer returns the address parsed from the given endpoint and a context dialer.
 func GetAddressAndDialer(endpoint string) (string, func(ctx context.Context, addr string) (net.Conn, error), error) {
-	protocol, addr, err := parseEndpointWithFallbackProtocol(endpoint, utils.UnixProtocol)
-	if err != nil {
-		return "", nil, err
-	}
-	if protocol != utils.UnixProtocol {
-		return "", nil, fmt.Errorf("only support unix socket endpoint")
-	}
-
-	return addr, dial, nil
+	return utils.GetAddressAndDialer(endpoint)
 }
 
-func dial(ctx context.Context, addr string) (net.Conn, error) {
-	return (&net.Dialer{}).DialContext(ctx, utils.UnixProtocol, addr)
-}
-
-func parseEndpointWithFallbackProtocol(endpoint string, fallbackProtocol string) (protocol string, addr string, err error) {
-	if protocol, addr, err = parseEndpoint(endpoint); err != nil && protocol == "" {
-		fallbackEndpoint := fallbackProtocol + "://" + endpoint
-		protocol, addr, err = parseEndpoint(fallbackEndpoint)
-		if err == nil {
-			logrus.Warningf("Using %q as endpoint is deprecated, please consider using full url format %q.", endpoint, fallbackEndpoint)
-		}
-	}
-	return
+// DetectedRuntime is the outcome of probing an endpoint as a container runtime
+type DetectedRuntime struct {
+	Runtime  string `json:"runtime"`
+	Endpoint string `json:"endpoint"`
+	// Distribution, Rootless and CRIOnly come from the catalog entry of the endpoint
+	Distribution string `json:"distribution,omitempty"`
+	Rootless     bool   `json:"rootless,omitempty"`
+	CRIOnly      bool   `json:"cri_only,omitempty"`
+	// Reachable tells the endpoint answered as the runtime
+	Reachable bool `json:"reachable"`
+	// Running tells the runtime has containers
+	Running bool `json:"running"`
+	// Kubernetes tells the runtime has containers created by the kubelet
+	Kubernetes bool   `json:"kubernetes"`
+	Version    string `json:"version,omitempty"`
+	// Error is why the probe failed, empty when it succeeded
+	Error string `json:"error,omitempty"`
 }
 
-func parseEndpoint(endpoint string) (string, string, error) {
-	u, err := url.Parse(endpoint)
+// dialEndpoint checks the endpoint accepts connections
+func dialEndpoint(ctx context.Context, endPoint string) error {
+	addr, dialer, err := GetAddressAndDialer(endPoint)
 	if err != nil {
-		return "", "", err
+		return err
 	}
-
-	switch u.Scheme {
-	case "tcp":
-		return "tcp", u.Host, nil
-
-	case "unix":
-		return "unix", u.Path, nil
-
-	case "":
-		return "", "", fmt.Errorf("using %q as endpoint is deprecated, please consider using full url format", endpoint)
-
-	default:
-		return u.Scheme, "", fmt.Errorf("protocol %q not supported", u.Scheme)
+	conn, err := dialer(ctx, addr)
+	if err != nil {
+		return fmt.Errorf("connect to endpoint %s: %w", endPoint, err)
 	}
+	return conn.Close()
 }
 
-func checkDockerRuntime(endPoint string) (bool, error) {
-	addr, _, err := GetAddressAndDialer(endPoint)
+func checkDockerRuntime(ctx context.Context, detected *DetectedRuntime, o *options) error {
+	if err := dialEndpoint(ctx, detected.Endpoint); err != nil {
+		return err
+	}
+	dockerCli, err := docker.NewClient(detected.Endpoint, o.tls)
 	if err != nil {
-		return false, err
+		return err
 	}
-	_, err = net.DialTimeout(utils.UnixProtocol, addr, utils.Timeout)
+	defer dockerCli.Close()
+	version, err := dockerCli.ServerVersion(ctx)
 	if err != nil {
-		return false, errors.New("could not connect to endpoint '" + endPoint + "'")
+		return errors.Wrapf(err, " :error getting docker version")
 	}
-	running, err := isDockerRunning(endPoint)
+	detected.Reachable = true
+	detected.Version = version.Version
+	containers, err := dockerCli.ContainerList(ctx,
+		containerTypes.ListOptions{
+			All: true, Size: false,
+		})
 	if err != nil {
-		return false, err
+		return errors.Wrapf(err, " :error listing docker containers")
 	}
-	if !running {
-		logrus.Debugf("no running containers found with endpoint %s", endPoint)
-		return false, nil
+	detected.Running = len(containers) > 0
+	for _, c := range containers {
+		if c.Labels[types.PodNameLabel] != "" {
+			detected.Kubernetes = true
+			break
+		}
 	}
-	return true, nil
+	return nil
 }
 
-func checkPodmanRuntime(endPoint string) (bool, error) {
-	running, err := isPodmanRunning(endPoint)
+func checkPodmanRuntime(ctx context.Context, detected *DetectedRuntime, o *options) error {
+	// ssh:// endpoints are reached by podman itself
+	if !utils.IsSSHEndpoint(detected.Endpoint) {
+		if err := dialEndpoint(ctx, detected.Endpoint); err != nil {
+			return err
+		}
+	}
+	remoteArgs := utils.PodmanRemoteArgs(detected.Endpoint, o.tls, o.sshIdentity)
+	op, err := utils.RunCommand(exec.CommandContext(ctx, "podman", append(remoteArgs, "version", "--format", "{{.Server.Version}}")...), "podman version:")
 	if err != nil {
-		return false, err
+		return err
 	}
-	if !running {
-		logrus.Debugf("no running containers found with endpoint %s", endPoint)
-		return false, nil
+	detected.Reachable = true
+	detected.Version = strings.TrimSpace(op.String())
+	op, err = utils.RunCommand(exec.CommandContext(ctx, "podman", append(remoteArgs, "ps", "--all", "--quiet")...), "podman ps:")
+	if err != nil {
+		return err
 	}
-	return true, nil
+	detected.Running = strings.TrimSpace(op.String()) != ""
+	return nil
 }
 
-func checkContainerdRuntime(endPoint string) (bool, error) {
-	addr, dialer, err := GetAddressAndDialer(endPoint)
+func checkContainerdRuntime(ctx context.Context, detected *DetectedRuntime, o *options) error {
+	if err := dialEndpoint(ctx, detected.Endpoint); err != nil {
+		return err
+	}
+	addr, _, err := GetAddressAndDialer(detected.Endpoint)
 	if err != nil {
-		return false, err
+		return err
 	}
-	ctx, cancel := context.WithTimeout(context.Background(), utils.Timeout)
-	defer cancel()
-	_, err = grpc.DialContext(ctx, addr, grpc.WithTransportCredentials(insecure.NewCredentials()), grpc.WithBlock(), grpc.WithContextDialer(dialer))
+	clientd, err := containerd.New(addr, containerd.WithTimeout(o.timeout))
 	if err != nil {
-		return false, errors.New("could not connect to endpoint '" + endPoint + "'")
+		return errors.Wrapf(err, " :error creating containerd client")
 	}
-	running, err := isContainerdRunning(endPoint)
+	defer clientd.Close()
+	version, err := clientd.Version(ctx)
 	if err != nil {
-		return false, err
+		return errors.Wrapf(err, " :error getting containerd version")
 	}
-	if !running {
-		logrus.Debugf("no running containers found with endpoint %s", endPoint)
-		return false, nil
+	detected.Reachable = true
+	detected.Version = version.Version
+	list, err := clientd.NamespaceService().List(ctx)
+	if err != nil {
+		return errors.Wrapf(err, " :error listing containerd namespaces")
 	}
-	return true, nil
+	for _, l := range list {
+		// the scratch containers of ExtractFileSystem are not containers of the node
+		if l == selfContainerd.TempNamespace {
+			continue
+		}
+		containers, err := clientd.Containers(namespaces.WithNamespace(ctx, l))
+		if err != nil {
+			return errors.Wrapf(err, " :error listing containerd containers")
+		}
+		if len(containers) > 0 {
+			detected.Running = true
+			detected.Kubernetes = detected.Kubernetes || l == utils.CONTAINERD_K8S_NS
+		}
+	}
+	return nil
+}
+
+func checkCrioRuntime(ctx context.Context, detected *DetectedRuntime) error {
+	return checkCRIEndpoint(ctx, detected, "cri-o")
 }
 
-func checkCrioRuntime(endPoint string) (bool, error) {
-	addr, _, err := GetAddressAndDialer(endPoint)
+// checkCRIEndpoint probes a CRI endpoint, runtimeName is the name it must report, any when empty
+func checkCRIEndpoint(ctx context.Context, detected *DetectedRuntime, runtimeName string) error {
+	conn, err := utils.NewGRPCClient(detected.Endpoint)
 	if err != nil {
-		return false, err
+		return errors.Wrapf(err, " :error creating cri client")
 	}
-	_, err = net.DialTimeout(utils.UnixProtocol, addr, utils.Timeout)
+	defer conn.Close()
+	runtimeService := runtimeapi.NewRuntimeServiceClient(conn)
+	version, err := runtimeService.Version(ctx, &runtimeapi.VersionRequest{})
 	if err != nil {
-		return false, errors.New("could not connect to endpoint '" + endPoint + "'")
+		return fmt.Errorf("connect to endpoint %s: %w", detected.Endpoint, err)
+	}
+	// containerd serves CRI as well, only take the endpoint for CRI-O when it says so
+	if runtimeName != "" && version.RuntimeName != "" && version.RuntimeName != runtimeName {
+		return fmt.Errorf("endpoint '%s' serves %s, not %s", detected.Endpoint, version.RuntimeName, runtimeName)
 	}
-	running, err := isCRIORunning(endPoint)
+	detected.Reachable = true
+	detected.Version = version.RuntimeVersion
+	resp, err := runtimeService.ListContainers(ctx, &runtimeapi.ListContainersRequest{})
 	if err != nil {
-		return false, err
+		return errors.Wrapf(err, " :error listing cri containers")
 	}
-	if !running {
-		logrus.Debugf("no running containers found with endpoint %s", endPoint)
-		return false, nil
+	detected.Running = len(resp.Containers) > 0
+	for _, c := range resp.Containers {
+		if c.Labels[types.PodNameLabel] != "" {
+			detected.Kubernetes = true
+			break
+		}
 	}
-	return true, nil
+	return nil
 }
 
-type containerRuntime struct {
-	Runtime   string
-	Endpoint  string
-	Connected bool
+// checkRuntime probes the endpoint of detected as its runtime and records the outcome in detected
+func checkRuntime(ctx context.Context, detected *DetectedRuntime, o *options) {
+	var err error
+	switch {
+	case detected.CRIOnly:
+		err = checkCRIEndpoint(ctx, detected, "")
+	case detected.Runtime == utils.DOCKER:
+		err = checkDockerRuntime(ctx, detected, o)
+	case detected.Runtime == utils.CONTAINERD:
+		err = checkContainerdRuntime(ctx, detected, o)
+	case detected.Runtime == utils.CRIO:
+		err = checkCrioRuntime(ctx, detected)
+	case detected.Runtime == utils.PODMAN:
+		err = checkPodmanRuntime(ctx, detected, o)
+	default:
+		err = fmt.Errorf("unknown container runtime %s", detected.Runtime)
+	}
+	if err != nil {
+		detected.Error = err.Error()
+		logrus.Debug(err)
+		return
+	}
+	if !detected.Running {
+		logrus.Debugf("no running containers found with endpoint %s", detected.Endpoint)
+	}
 }
 
-// getContainerRuntime returns the underlying container runtime, and it's socket path
-func getContainerRuntime() (string, string, error) {
-	var wg sync.WaitGroup
-	var detectedRuntimes []containerRuntime
-	var connectedRuntimes []containerRuntime
-	detectedRuntimeChannel := make(chan containerRuntime, 1)
-
-	for runtime, endPoints := range utils.SupportedRuntimes {
-		for _, endPoint := range endPoints {
-			wg.Add(1)
-			go func(runtime, endPoint string) {
-				logrus.Debugf("trying to connect to endpoint '%s' with timeout '%s'", endPoint, utils.Timeout)
-				var connected bool
-				var err error
-				switch runtime {
-				case utils.DOCKER:
-					connected, err = checkDockerRuntime(endPoint)
-				case utils.CONTAINERD:
-					connected, err = checkContainerdRuntime(endPoint)
-				case utils.CRIO:
-					connected, err = checkCrioRuntime(endPoint)
-				case utils.PODMAN:
-					connected, err = checkPodmanRuntime(endPoint)
-				default:
-					err = fmt.Errorf("unknown container runtime %s", runtime)
-				}
-				if err != nil {
-					logrus.Debugf(err.Error())
-					wg.Done()
-					return
-				}
-				detectedRuntimeChannel <- containerRuntime{Runtime: runtime, Endpoint: endPoint, Connected: connected}
-				if connected {
-					logrus.Infof("connected successfully to endpoint: %s", endPoint)
-				}
-			}(runtime, endPoint)
+// candidates lists the runtime and endpoint pairs to probe, in order of preference:
+// the runtimes in the order of the options, then the endpoints in the order of the catalog
+func (o *options) candidates() []DetectedRuntime {
+	var candidates []DetectedRuntime
+	seen := map[DetectedRuntime]bool{}
+	for _, runtime := range o.order() {
+		if o.endpoint != "" {
+			candidates = append(candidates, DetectedRuntime{Runtime: runtime, Endpoint: o.endpoint})
+			continue
 		}
-	}
-
-	go func() {
-		for detectedRuntime := range detectedRuntimeChannel {
-			detectedRuntimes = append(detectedRuntimes, detectedRuntime)
-			if detectedRuntime.Connected {
-				connectedRuntimes = append(connectedRuntimes, detectedRuntime)
+		for _, endpoint := range utils.Endpoints {
+			if endpoint.Runtime != runtime {
+				continue
+			}
+			for _, uri := range endpoint.Expand() {
+				key := DetectedRuntime{Runtime: runtime, Endpoint: uri}
+				if seen[key] {
+					continue
+				}
+				seen[key] = true
+				candidates = append(candidates, DetectedRuntime{
+					Runtime:      runtime,
+					Endpoint:     uri,
+					Distribution: endpoint.Distribution,
+					Rootless:     endpoint.Rootless,
+					CRIOnly:      endpoint.CRIOnly,
+				})
 			}
-			wg.Done()
-		}
-	}()
-
-	wg.Wait()
-	if len(connectedRuntimes) == 0 {
-		if len(detectedRuntimes) == 0 {
-			return "", "", nil
-		} else {
-			logrus.Infof("No running runtimes, selecting first detected runtime")
-			return detectedRuntimes[0].Runtime, detectedRuntimes[0].Endpoint, nil
 		}
 	}
-	return connectedRuntimes[0].Runtime, connectedRuntimes[0].Endpoint, nil
+	return candidates
 }
 
-// AutoDetectRuntime auto detects the underlying container runtime like docker, containerd
-func AutoDetectRuntime() (string, string, error) {
-	runtime, endpoint, err := getContainerRuntime()
-	if err != nil {
-		return "", "", err
-	}
-	if runtime == "" {
-		return "", "", errors.New("could not detect container runtime")
+// probeAll probes the candidates concurrently, the results keep the order of the candidates
+func probeAll(ctx context.Context, o *options) []DetectedRuntime {
+	var wg sync.WaitGroup
+	candidates := o.candidates()
+	for i := range candidates {
+		wg.Add(1)
+		go func(candidate *DetectedRuntime) {
+			defer wg.Done()
+			logrus.Debugf("trying to connect to endpoint '%s' with timeout '%s'", candidate.Endpoint, o.timeout)
+			probeCtx, cancel := context.WithTimeout(ctx, o.timeout)
+			defer cancel()
+			checkRuntime(probeCtx, candidate, o)
+			if candidate.Running {
+				logrus.Infof("connected successfully to endpoint: %s", candidate.Endpoint)
+			}
+		}(&candidates[i])
 	}
-	logrus.Infof("container runtime detected: %s\n", runtime)
-	return runtime, endpoint, nil
+	wg.Wait()
+	return candidates
 }
 
-func isDockerRunning(host string) (bool, error) {
-	dockerCli, err := client.NewClientWithOpts(client.WithAPIVersionNegotiation(), client.WithHost(host), client.WithTimeout(utils.Timeout))
-	if err != nil {
-		return false, errors.Wrapf(err, " :error creating docker client")
-	}
-	defer dockerCli.Close()
-	containers, err := dockerCli.ContainerList(context.Background(),
-		containerTypes.ListOptions{
-			All: true, Size: false,
-		})
-	if err != nil {
-		return false, errors.Wrapf(err, " :error creating docker client")
+// DetectAll probes every endpoint the options allow and reports each of them,
+// whether or not it answered
+func DetectAll(ctx context.Context, opts ...Option) ([]DetectedRuntime, error) {
+	o := newOptions(opts...)
+	if err := o.validate(); err != nil {
+		return nil, err
 	}
+	detected := probeAll(ctx, o)
+	return detected, ctx.Err()
+}
 
-	return len(containers) > 0, nil
+// Detection is the runtime selected by the detection and why
+type Detection struct {
+	DetectedRuntime
+	// Rule is the rule of the policy which selected the runtime
+	Rule string `json:"rule"`
+	// Reason explains the choice
+	Reason string `json:"reason"`
+	// Candidates are the probed endpoints, in order of preference
+	Candidates []DetectedRuntime `json:"candidates,omitempty"`
 }
 
-func isPodmanRunning(host string) (bool, error) {
-	op, err := utils.RunCommand(exec.Command("podman", "--remote", "--url", host, "ps"), "podman ps:")
-	if err != nil {
-		logrus.Warn(err.Error())
-		return false, err
+// The rules of the detection policy, from the strongest to the weakest.
+// Within a rule the candidate coming first in the preference order wins.
+const (
+	// RuleForced selects the runtime and endpoint given in the options without probing
+	RuleForced = "forced"
+	// RuleKubeletConfigured selects the runtime the kubelet flags, config or node object declare
+	RuleKubeletConfigured = "kubelet-configured"
+	// RuleKubelet selects the runtime running the containers of the kubelet
+	RuleKubelet = "kubelet"
+	// RuleRunning selects a runtime running containers
+	RuleRunning = "running"
+	// RuleReachable selects a runtime answering on its endpoint
+	RuleReachable = "reachable"
+)
+
+// selectRuntime applies the detection policy to the probed candidates, nil when none answered
+func selectRuntime(candidates []DetectedRuntime, o *options) *Detection {
+	order := strings.Join(o.order(), ", ")
+	rules := []struct {
+		rule   string
+		match  func(DetectedRuntime) bool
+		reason string
+	}{
+		{RuleKubelet, func(d DetectedRuntime) bool { return o.preferKubelet && d.Kubernetes }, "runs the containers of the kubelet"},
+		{RuleRunning, func(d DetectedRuntime) bool { return d.Running }, "runs containers"},
+		{RuleReachable, func(d DetectedRuntime) bool { return d.Reachable }, "answers but no runtime runs containers"},
+	}
+	for _, rule := range rules {
+		for _, candidate := range candidates {
+			if !candidate.CRIOnly && rule.match(candidate) {
+				return &Detection{
+					DetectedRuntime: candidate,
+					Rule:            rule.rule,
+					Reason:          fmt.Sprintf("%s on %s %s, preference order: %s", candidate.Runtime, candidate.Endpoint, rule.reason, order),
+					Candidates:      candidates,
+				}
+			}
+		}
 	}
-	return len(strings.Split(strings.TrimSpace(op.String()), "\n")) > 1, nil
+	return nil
 }
 
-func isContainerdRunning(host string) (bool, error) {
-	clientd, err := containerd.New(strings.Replace(host, "unix://", "", 1))
-	if err != nil {
-		return false, errors.Wrapf(err, " :error creating containerd client")
+// Detect probes the endpoints the options allow and selects the runtime to use,
+// the returned detection tells which rule selected it
+func Detect(ctx context.Context, opts ...Option) (*Detection, error) {
+	o := newOptions(opts...)
+	if err := o.validate(); err != nil {
+		return nil, err
 	}
-	defer clientd.Close()
-	namespace_store := clientd.NamespaceService()
+	return detectRuntime(ctx, o)
+}
 
-	list, err := namespace_store.List(context.Background())
+// AutoDetectRuntime auto detects the underlying container runtime like docker, containerd
+func AutoDetectRuntime() (string, string, error) {
+	detection, err := detectRuntime(context.Background(), newOptions())
 	if err != nil {
-		return false, errors.Wrapf(err, " :error creating containerd client")
+		return "", "", err
 	}
-	for _, l := range list {
-
-		namespace := namespaces.WithNamespace(context.Background(), l)
-
-		containers, err := clientd.Containers(namespace)
-		if err != nil {
-			return false, errors.Wrapf(err, " :error creating containerd client")
-		}
+	return detection.Runtime, detection.Endpoint, nil
+}
 
-		if len(containers) > 0 {
-			return true, nil
+// detectRuntime finds the runtime and endpoint to use among the candidates allowed by o
+func detectRuntime(ctx context.Context, o *options) (*Detection, error) {
+	if o.runtime != "" && o.endpoint != "" {
+		return &Detection{
+			DetectedRuntime: DetectedRuntime{Runtime: o.runtime, Endpoint: o.endpoint},
+			Rule:            RuleForced,
+			Reason:          fmt.Sprintf("%s on %s given in the options", o.runtime, o.endpoint),
+		}, nil
+	}
+	var detection *Detection
+	if o.preferKubelet && o.endpoint == "" {
+		detection = kubeletDetection(ctx, o)
+	}
+	if detection == nil {
+		candidates := probeAll(ctx, o)
+		if err := ctx.Err(); err != nil {
+			return nil, errdefs.Wrap(o.runtime, "detect", "", nil, err)
 		}
+		detection = selectRuntime(candidates, o)
 	}
-
-	return false, nil
-
-}
-
-func isCRIORunning(host string) (bool, error) {
-	cmd := exec.Command("crictl", "--runtime-endpoint", host, "ps", "-q")
-	logrus.Debugf("command: %s", cmd.String())
-	output, err := cmd.Output()
-	if err != nil {
-		logrus.Errorf("%s, error: %s", output, err)
-		return false, err
+	if detection == nil {
+		return nil, errors.Wrap(ErrRuntimeUnreachable, "could not detect container runtime")
 	}
-	return true, nil
+	logrus.Infof("container runtime detected: %s, rule: %s, reason: %s\n", detection.Runtime, detection.Rule, detection.Reason)
+	return detection, nil
 }
 
 // NewRuntime Auto detect and returns the runtime available for the current system
 func NewRuntime() (Runtime, error) {
+	return NewRuntimeWithOptions()
+}
 
-	runtime, endpoint, err := AutoDetectRuntime()
+// NewRuntimeWithOptions returns the runtime selected by the options, detection only runs
+// for what the options leave open: no detection at all when both the runtime and the endpoint are given
+func NewRuntimeWithOptions(opts ...Option) (Runtime, error) {
+	o := newOptions(opts...)
+	if err := o.validate(); err != nil {
+		return nil, err
+	}
+	detection, err := detectRuntime(context.Background(), o)
 	if err != nil {
 		return nil, err
 	}
+	return newRuntime(detection.Runtime, detection.Endpoint, o)
+}
 
-	if runtime == utils.DOCKER {
-		return docker.New(endpoint), nil
-	} else if runtime == utils.CONTAINERD {
-		return selfContainerd.New(endpoint), nil
-	} else if runtime == utils.CRIO {
+// newRuntime instantiates the backend of the runtime connected to endpoint
+func newRuntime(runtime, endpoint string, o *options) (Runtime, error) {
+	switch runtime {
+	case utils.DOCKER:
+		return docker.NewRemote(endpoint, o.tls), nil
+	case utils.CONTAINERD:
+		return selfContainerd.New(endpoint).WithNamespace(o.namespace), nil
+	case utils.CRIO:
 		return crio.New(endpoint), nil
-	} else if runtime == utils.PODMAN {
-		return selfPodman.New(endpoint), nil
+	case utils.PODMAN:
+		if o.insecure {
+			return nil, errInsecurePodman
+		}
+		return selfPodman.NewRemote(endpoint, o.tls, o.sshIdentity), nil
 	}
-
 	return nil, errors.New("Unknown runtime")
 }
@@ -0,0 +1,69 @@
+package vessel
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/deepfence/vessel/utils"
+)
+
+func TestSelectRuntime(t *testing.T) {
+	docker := DetectedRuntime{Runtime: utils.DOCKER, Endpoint: "unix:///var/run/docker.sock", Reachable: true}
+	containerd := DetectedRuntime{Runtime: utils.CONTAINERD, Endpoint: "unix:///run/containerd/containerd.sock", Reachable: true}
+	podman := DetectedRuntime{Runtime: utils.PODMAN, Endpoint: "unix:///run/podman/podman.sock", Reachable: true}
+	criDockerd := DetectedRuntime{Runtime: utils.DOCKER, Endpoint: "unix:///run/cri-dockerd.sock", Reachable: true, CRIOnly: true}
+	running := func(d DetectedRuntime) DetectedRuntime {
+		d.Running = true
+		return d
+	}
+	kubernetes := func(d DetectedRuntime) DetectedRuntime {
+		d.Running, d.Kubernetes = true, true
+		return d
+	}
+	tests := []struct {
+		name       string
+		candidates []DetectedRuntime
+		opts       []Option
+		want       DetectedRuntime
+		rule       string
+	}{
+		{"kubelet before running", []DetectedRuntime{running(docker), kubernetes(containerd)}, nil, kubernetes(containerd), RuleKubelet},
+		{"kubelet rule off", []DetectedRuntime{running(docker), kubernetes(containerd)}, []Option{WithKubeletPreference(false)}, running(docker), RuleRunning},
+		{"running before reachable", []DetectedRuntime{docker, running(containerd)}, nil, running(containerd), RuleRunning},
+		{"first running in order", []DetectedRuntime{running(docker), running(podman)}, nil, running(docker), RuleRunning},
+		{"first reachable in order", []DetectedRuntime{containerd, docker}, nil, containerd, RuleReachable},
+		{"kubelet ties broken by order", []DetectedRuntime{kubernetes(containerd), kubernetes(docker)}, nil, kubernetes(containerd), RuleKubelet},
+		{"CRI only never selected", []DetectedRuntime{kubernetes(criDockerd), containerd}, nil, containerd, RuleReachable},
+		{"unreachable skipped", []DetectedRuntime{{Runtime: utils.DOCKER, Endpoint: "unix:///var/run/docker.sock"}, podman}, nil, podman, RuleReachable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			detection := selectRuntime(tt.candidates, newOptions(tt.opts...))
+			if detection == nil {
+				t.Fatal("no runtime selected")
+			}
+			if detection.DetectedRuntime != tt.want || detection.Rule != tt.rule {
+				t.Fatalf("selected %+v by %s, want %+v by %s", detection.DetectedRuntime, detection.Rule, tt.want, tt.rule)
+			}
+		})
+	}
+	if detection := selectRuntime([]DetectedRuntime{{Runtime: utils.DOCKER}, criDockerd}, newOptions()); detection != nil {
+		t.Fatalf("selected %+v among unreachable and CRI only endpoints", detection.DetectedRuntime)
+	}
+}
+
+func TestCandidatesOrder(t *testing.T) {
+	o := newOptions(WithPreference(utils.CRIO, utils.DOCKER), WithEndpoint("unix:///run/runtime.sock"))
+	want := []DetectedRuntime{
+		{Runtime: utils.CRIO, Endpoint: "unix:///run/runtime.sock"},
+		{Runtime: utils.DOCKER, Endpoint: "unix:///run/runtime.sock"},
+	}
+	if got := o.candidates(); !reflect.DeepEqual(got, want) {
+		t.Fatalf("candidates %+v, want %+v", got, want)
+	}
+	// the forced runtime overrides the preference
+	o = newOptions(WithPreference(utils.CRIO, utils.DOCKER), WithRuntime(utils.PODMAN), WithEndpoint("unix:///run/runtime.sock"))
+	if got := o.candidates(); len(got) != 1 || got[0].Runtime != utils.PODMAN {
+		t.Fatalf("candidates %+v, want podman only", got)
+	}
+}
@@ -1,7 +1,12 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
 	"os"
+	"text/tabwriter"
 
 	"github.com/deepfence/vessel"
 	"github.com/joho/godotenv"
@@ -11,7 +16,12 @@ import (
 var activeRuntime string
 var activeEndpoint string
 
-func init() {
+var (
+	detectAll  = flag.Bool("all", false, "report every probed runtime endpoint instead of writing .env")
+	jsonOutput = flag.Bool("json", false, "print the -all report as json")
+)
+
+func detect() {
 	var err error
 	// Auto-detect underlying container runtime
 	activeRuntime, activeEndpoint, err = vessel.AutoDetectRuntime()
@@ -38,11 +48,39 @@ func setDotEnvVariable(envars map[string]string) error {
 	return godotenv.Write(envars, "./.env")
 }
 
+// reportAll prints every probed endpoint as a table or as json
+func reportAll() error {
+	detected, err := vessel.DetectAll(context.Background())
+	if err != nil {
+		return err
+	}
+	if *jsonOutput {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(detected)
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "RUNTIME\tDISTRIBUTION\tENDPOINT\tREACHABLE\tRUNNING\tVERSION\tERROR")
+	for _, d := range detected {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%t\t%t\t%s\t%s\n", d.Runtime, d.Distribution, d.Endpoint, d.Reachable, d.Running, d.Version, d.Error)
+	}
+	return w.Flush()
+}
+
 func main() {
+	flag.Parse()
+	if *detectAll {
+		if err := reportAll(); err != nil {
+			logrus.Error(err)
+			os.Exit(1)
+		}
+		return
+	}
+	detect()
 	if activeRuntime != "" {
 		envVars := map[string]string{
-			"CONTAINER_RUNTIME": activeRuntime,
-			"CRI_ENDPOINT":      activeEndpoint,
+			vessel.RuntimeEnv:  activeRuntime,
+			vessel.EndpointEnv: activeEndpoint,
 		}
 		err := setDotEnvVariable(envVars)
 		if err != nil {
@@ -1,32 +1,43 @@
 package containerd
 
 import (
-	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"math/rand"
+	"io"
 	"os"
-	"os/exec"
 	"path"
+	"slices"
 	"strings"
-	"time"
 
+	"github.com/deepfence/vessel/errdefs"
+	"github.com/deepfence/vessel/types"
 	"github.com/deepfence/vessel/utils"
 	"github.com/sirupsen/logrus"
 
 	containerdApi "github.com/containerd/containerd"
+	"github.com/containerd/containerd/content"
+	containerdErrdefs "github.com/containerd/containerd/errdefs"
 	"github.com/containerd/containerd/images"
 	"github.com/containerd/containerd/images/archive"
+	"github.com/containerd/containerd/leases"
+	"github.com/containerd/containerd/mount"
 	"github.com/containerd/containerd/namespaces"
 	"github.com/containerd/containerd/oci"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/containerd/platforms"
+	"github.com/distribution/reference"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
 )
 
 // New instantiates a new Containerd runtime object
 func New(host string) *Containerd {
 	return &Containerd{
 		socketPath: host,
-		namespaces: getNamespaces(host),
+		namespaces: &namespaceList{names: getNamespaces(host)},
 	}
 }
 
@@ -50,51 +61,176 @@ func (c Containerd) GetSocket() string {
 	return c.socketPath
 }
 
-// ImageExists checks if the image exists
-func (c Containerd) ImageExists(imageName string) bool {
-	_, err := exec.Command("nerdctl", "inspect", imageName, "--address", c.socketPath).Output()
+// newClient returns a containerd client connected to the socket
+func (c Containerd) newClient() (*containerdApi.Client, error) {
+	return containerdApi.New(strings.Replace(c.socketPath, "unix://", "", 1))
+}
+
+type namespacedImage struct {
+	namespace string
+	image     images.Image
+}
+
+// imageMatcher tells whether a containerd image is the one asked for by tag, digest or id
+type imageMatcher struct {
+	names  []string
+	digest digest.Digest
+}
+
+// newImageMatcher accepts a tag, a repo@digest, a manifest digest, or an id with or without its sha256: prefix,
+// the CRI plugin records the config digest of every image as one of its names
+func newImageMatcher(imageName string) imageMatcher {
+	m := imageMatcher{names: []string{imageName}}
+	if d, err := digest.Parse(imageName); err == nil {
+		m.digest = d
+		return m
+	}
+	if d, err := digest.Parse("sha256:" + imageName); err == nil {
+		m.digest = d
+		m.names = append(m.names, d.String())
+		return m
+	}
+	if named, err := reference.ParseDockerRef(imageName); err == nil {
+		m.names = append(m.names, named.String())
+		if digested, ok := named.(reference.Digested); ok {
+			m.digest = digested.Digest()
+		}
+	}
+	return m
+}
+
+func (m imageMatcher) match(img images.Image) bool {
+	return slices.Contains(m.names, img.Name) || (m.digest != "" && img.Target.Digest == m.digest)
+}
+
+// findImages looks the image up by name, digest or id in the namespaces of the operation, it returns them along,
+// the namespaces which can not be listed only fail the lookup when no other namespace has the image
+func (c Containerd) findImages(ctx context.Context, client *containerdApi.Client, imageName string) ([]namespacedImage, []string, error) {
+	matcher := newImageMatcher(imageName)
+	var found []namespacedImage
+	var failures []error
+	searched, err := c.searchNamespaces(ctx, client, func(nsList []string) (bool, error) {
+		for _, ns := range nsList {
+			imgs, err := client.ImageService().List(namespaces.WithNamespace(ctx, ns))
+			if err != nil {
+				failures = append(failures, fmt.Errorf("namespace: %s, err: %w", ns, err))
+				continue
+			}
+			for _, img := range imgs {
+				if matcher.match(img) {
+					found = append(found, namespacedImage{namespace: ns, image: img})
+				}
+			}
+		}
+		return len(found) > 0, nil
+	})
 	if err != nil {
-		return false
+		return nil, nil, err
 	}
-	return true
+	if len(found) == 0 && len(failures) > 0 {
+		return nil, searched, errors.Join(failures...)
+	}
+	return found, searched, nil
 }
 
-// ExtractImage will create the tarball from the containerd image, extracts into dir
-// and then skopeo is used to migrate oci layers using the dir to docker v1 layer spec format tar
-// and again extracts back to dir
-// example:
-// skopeo copy oci:///home/ubuntu/img/docker/threatmapper_containerd-dir \
-// docker-archive:/home/ubuntu/img/docker/threatmapper_containerd.tar
-func (c Containerd) ExtractImage(imageID, imageName, path string) error {
-	var stderr bytes.Buffer
-	save := exec.Command("nerdctl", "save", imageName, "--address", c.socketPath)
-	save.Stderr = &stderr
-	extract := exec.Command("tar", "xf", "-", "--warning=none", "-C"+path)
-	extract.Stderr = &stderr
-	pipe, err := extract.StdinPipe()
+// loadContainer loads the container from namespace, or from the namespaces of the operation when namespace is empty
+func (c Containerd) loadContainer(ctx context.Context, client *containerdApi.Client, containerId string, namespace string) (string, containerdApi.Container, error) {
+	var foundNs string
+	var found containerdApi.Container
+	search := func(nsList []string) (bool, error) {
+		for _, ns := range nsList {
+			container, err := client.LoadContainer(namespaces.WithNamespace(ctx, ns), containerId)
+			if containerdErrdefs.IsNotFound(err) {
+				continue
+			}
+			if err != nil {
+				return false, fmt.Errorf("namespace: %s, container %s: %w", ns, containerId, err)
+			}
+			foundNs, found = ns, container
+			return true, nil
+		}
+		return false, nil
+	}
+	searched := []string{namespace}
+	var err error
+	if namespace != "" {
+		_, err = search(searched)
+	} else {
+		searched, err = c.searchNamespaces(ctx, client, search)
+	}
 	if err != nil {
-		return err
+		return "", nil, err
+	}
+	if found == nil {
+		return "", nil, fmt.Errorf("%w: %s in namespaces %v", errdefs.ErrContainerNotFound, containerId, searched)
 	}
-	save.Stdout = pipe
+	return foundNs, found, nil
+}
+
+// ImageExists checks if the image exists
+func (c Containerd) ImageExists(imageName string) bool {
+	return c.ImageExistsContext(context.Background(), imageName)
+}
 
-	err = extract.Start()
+// ImageExistsContext checks if the image exists in any namespace,
+// containerd failing to answer is logged and reported as missing
+func (c Containerd) ImageExistsContext(ctx context.Context, imageName string) bool {
+	location, err := c.LookupImage(ctx, imageName)
 	if err != nil {
-		return errors.New(stderr.String())
+		logrus.Debug(err.Error())
 	}
-	err = save.Run()
+	return location != nil
+}
+
+// LookupImage finds the image by name, digest or id in every namespace,
+// the id is the manifest digest of the image in the first namespace holding it
+func (c Containerd) LookupImage(ctx context.Context, imageName string) (_ *types.ImageLocation, err error) {
+	// no notFound hint here nor in the other operations: a NotFound of containerd may as well be about
+	// a blob or a snapshot, the missing images and containers are reported by the backend itself
+	defer errdefs.Annotate(ctx, &err, utils.CONTAINERD, "lookup image", imageName, nil)
+	client, err := c.newClient()
 	if err != nil {
-		return errors.New(stderr.String())
+		return nil, err
 	}
-	err = pipe.Close()
+	defer client.Close()
+	found, _, err := c.findImages(ctx, client, imageName)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if len(found) == 0 {
+		return nil, nil
+	}
+	location := &types.ImageLocation{ID: found[0].image.Target.Digest.String()}
+	for _, img := range found {
+		if !slices.Contains(location.Namespaces, img.namespace) {
+			location.Namespaces = append(location.Namespaces, img.namespace)
+		}
 	}
-	err = extract.Wait()
+	return location, nil
+}
+
+// ExtractImage will create the tarball from the containerd image, extracts into dir
+// and then migrates the oci layers in the dir to docker v1 layer spec format
+func (c Containerd) ExtractImage(imageID, imageName, path string) error {
+	return c.ExtractImageContext(context.Background(), imageID, imageName, path)
+}
+
+// ExtractImageContext streams the image archive exported from the content store into dir
+// and migrates it to docker v1 layer spec format
+func (c Containerd) ExtractImageContext(ctx context.Context, imageID, imageName, path string) (err error) {
+	defer errdefs.Annotate(ctx, &err, utils.CONTAINERD, "extract image", imageName, nil)
+	reader, writer := io.Pipe()
+	go func() {
+		err := c.SaveTo(ctx, imageName, writer)
+		writer.CloseWithError(err)
+	}()
+	err = utils.ExtractTar(reader, path)
+	reader.CloseWithError(err)
 	if err != nil {
-		return errors.New(stderr.String())
+		return err
 	}
 
-	err = migrateOCIToDockerV1(path, imageID, "")
+	err = migrateOCIToDockerV1(ctx, path)
 	if err != nil {
 		return err
 	}
@@ -103,125 +239,174 @@ func (c Containerd) ExtractImage(imageID, imageName, path string) error {
 
 // GetImageID returns the image id
 func (c Containerd) GetImageID(imageName string) ([]byte, error) {
-	return exec.Command("nerdctl", "images", "-q", "--no-trunc", imageName, "--address", c.socketPath).Output()
+	return c.GetImageIDContext(context.Background(), imageName)
 }
 
-// Save just saves image using -o flag
-func (c Containerd) Save(imageName, outputParam string) ([]byte, error) {
-	nerrors := []error{}
-	for _, ns := range c.namespaces {
-		res, err := exec.Command("nerdctl", "-n", ns, "save", "--address", c.socketPath, "-o", outputParam, imageName).CombinedOutput()
-		if err == nil {
-			return res, nil
+// GetImageIDContext returns the target digests of the matching images, one per line
+func (c Containerd) GetImageIDContext(ctx context.Context, imageName string) (_ []byte, err error) {
+	defer errdefs.Annotate(ctx, &err, utils.CONTAINERD, "image id", imageName, nil)
+	client, err := c.newClient()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	found, _, err := c.findImages(ctx, client, imageName)
+	if err != nil {
+		return nil, err
+	}
+	var ids strings.Builder
+	seen := map[string]bool{}
+	for _, img := range found {
+		id := img.image.Target.Digest.String()
+		if !seen[id] {
+			seen[id] = true
+			ids.WriteString(id + "\n")
 		}
-		nerrors = append(nerrors, fmt.Errorf("namespace: %v, err: %v\n", ns, string(res)+err.Error()))
 	}
-	return nil, fmt.Errorf("Save failed. errors:\n%v", nerrors)
+	return []byte(ids.String()), nil
 }
 
-// migrateOCIToDockerV1 migrates OCI image to Docker v1 image tarball
-func migrateOCIToDockerV1(path, imageID, tarFilePath string) error {
-	if tarFilePath == "" {
-		tarFilePath = path + imageID + ".tar"
-	}
-	sourceDir := "oci://" + path
-	destinationTar := "docker-archive:" + tarFilePath
-	var stderr bytes.Buffer
+// Save just saves image using -o flag
+func (c Containerd) Save(imageName, outputParam string) ([]byte, error) {
+	return c.SaveContext(context.Background(), imageName, outputParam)
+}
 
-	// skopeo will convert oci dir into docker v1 tarball
-	skopeoCopy := exec.Command("/usr/bin/skopeo", "copy", sourceDir, destinationTar)
-	skopeoCopy.Stderr = &stderr
-	err := skopeoCopy.Run()
+// SaveContext exports the image for the host platform to outputParam
+func (c Containerd) SaveContext(ctx context.Context, imageName, outputParam string) (_ []byte, err error) {
+	defer errdefs.Annotate(ctx, &err, utils.CONTAINERD, "save", imageName, nil)
+	return nil, utils.WriteFileFunc(outputParam, func(w io.Writer) error {
+		return c.SaveTo(ctx, imageName, w)
+	})
+}
+
+// SaveTo exports the image for the host platform as an OCI archive with a docker manifest.json into w
+func (c Containerd) SaveTo(ctx context.Context, imageName string, w io.Writer) (err error) {
+	defer errdefs.Annotate(ctx, &err, utils.CONTAINERD, "save", imageName, nil)
+	client, err := c.newClient()
 	if err != nil {
-		return fmt.Errorf("failed to migrate OCI to Docker image: %v", stderr)
+		return err
 	}
-
-	// untar the docker archive
-	tarxf := exec.Command("tar", "xf", tarFilePath, "--warning=none", "-C"+path)
-	tarxf.Stderr = &stderr
-	err = tarxf.Run()
+	defer client.Close()
+	found, searched, err := c.findImages(ctx, client, imageName)
 	if err != nil {
-		return fmt.Errorf("failed to migrate OCI to Docker image: %v", err)
+		return err
 	}
-
-	// delete docker tar, not required
-	removeTar := exec.Command("rm", tarFilePath)
-	removeTar.Stderr = &stderr
-	err = removeTar.Run()
+	if len(found) == 0 {
+		return fmt.Errorf("%w: %s in namespaces %v", errdefs.ErrImageNotFound, imageName, searched)
+	}
+	ctx = namespaces.WithNamespace(ctx, found[0].namespace)
+	err = client.Export(ctx, w,
+		archive.WithImage(client.ImageService(), found[0].image.Name),
+		archive.WithPlatform(platforms.DefaultStrict()))
 	if err != nil {
-		return fmt.Errorf("failed to delete generated docker-archive: %v", err)
+		return fmt.Errorf("export %s from namespace %s: %w", imageName, found[0].namespace, err)
 	}
+	return nil
+}
 
+// migrateOCIToDockerV1 rewrites the OCI image layout extracted in path into the docker v1 layout,
+// the converted archive is streamed back into path without an intermediate tarball
+func migrateOCIToDockerV1(ctx context.Context, path string) error {
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(utils.ConvertOCIToDockerArchive(ctx, path, writer, utils.ConvertOptions{}))
+	}()
+	err := utils.ExtractTar(reader, path)
+	reader.CloseWithError(err)
+	if err != nil {
+		return fmt.Errorf("failed to migrate OCI to Docker image: %w", err)
+	}
 	return nil
 }
 
+// MigrateOCITarToDockerV1Tar converts the OCI image tarball dir/tarName into a docker-archive in place,
 // fileuploader specific
 func MigrateOCITarToDockerV1Tar(dir, tarName string) error {
 	logrus.Info("migrating image ...")
-	var stderr bytes.Buffer
 	tarPath := path.Join(dir, tarName)
-	_, err := exec.Command("tar", "xf", tarPath, "--warning=none", "-C"+dir).Output()
+	converted, err := os.CreateTemp(dir, tarName+".*")
 	if err != nil {
-		return fmt.Errorf("failed to migrate OCI to Docker image: failed to untar: %v", err)
+		return fmt.Errorf("failed to migrate OCI to Docker image: %w", err)
 	}
-
-	// delete docker tar, not required
-	removeTar := exec.Command("rm", tarPath)
-	removeTar.Stderr = &stderr
-	err = removeTar.Run()
-	if err != nil {
-		return fmt.Errorf("failed to delete generated docker-archive: %v", err)
+	defer os.Remove(converted.Name())
+	err = utils.ConvertOCIToDockerArchive(context.Background(), tarPath, converted, utils.ConvertOptions{})
+	if closeErr := converted.Close(); err == nil {
+		err = closeErr
 	}
-
-	//migrate now
-	sourceDir := "oci://" + dir
-	destinationTar := "docker-archive:" + tarPath
-	// var stderr bytes.Buffer
-
-	// skopeo will convert oci dir into docker v1 tarball
-	skopeoCopy := exec.Command("/usr/bin/skopeo", "copy", sourceDir, destinationTar)
-	skopeoCopy.Stderr = &stderr
-	err = skopeoCopy.Run()
 	if err != nil {
-		return fmt.Errorf("failed to migrate OCI to Docker image: %v", stderr)
+		return fmt.Errorf("failed to migrate OCI to Docker image: %w", err)
 	}
-	return nil
-
+	return os.Rename(converted.Name(), tarPath)
 }
 
 // ExtractFileSystem Extract the file system from tar of an image by creating a temporary dormant container instance
 func (c Containerd) ExtractFileSystem(imageTarPath string, outputTarPath string, imageName string) error {
+	return c.ExtractFileSystemContext(context.Background(), imageTarPath, outputTarPath, imageName)
+}
+
+// ExtractFileSystemContext Extract the file system from tar of an image by creating a temporary dormant container instance,
+// the temporary container, snapshot and image are released on every error path and even if ctx is cancelled.
+// They are created in TempNamespace under unique names labelled with TempLabel, and under a lease expiring after
+// TempLeaseExpiration: what a crashed run leaves is collected by containerd or by CleanupTemporaryResources.
+func (c Containerd) ExtractFileSystemContext(ctx context.Context, imageTarPath string, outputTarPath string, imageName string) (err error) {
+	defer errdefs.Annotate(ctx, &err, utils.CONTAINERD, "extract file system", imageName, nil)
 	// create a new client connected to the default socket path for containerd
-	client, err := containerdApi.New(strings.Replace(c.socketPath, "unix://", "", 1))
+	client, err := c.newClient()
 	if err != nil {
 		return err
 	}
 	defer client.Close()
-	// create a new context with an "temp" namespace
-	ctx := namespaces.WithNamespace(context.Background(), "temp")
+	run, err := newTempRun()
+	if err != nil {
+		return err
+	}
+	ctx = namespaces.WithNamespace(ctx, TempNamespace)
+	// the content and the snapshots of the run are held by its lease only
+	ctx, releaseLease, err := client.WithLease(ctx,
+		leases.WithID(run.id),
+		leases.WithLabels(run.labels),
+		leases.WithExpiration(TempLeaseExpiration))
+	if err != nil {
+		logrus.Error("Error while creating lease")
+		return err
+	}
+	defer func() {
+		cleanupCtx, cancel := utils.CleanupContext(ctx)
+		defer cancel()
+		if err := releaseLease(cleanupCtx); err != nil {
+			logrus.Warnf("Error while deleting lease %s: %s", run.id, err.Error())
+		}
+	}()
 	reader, err := os.Open(imageTarPath)
 	if err != nil {
 		logrus.Error("Error while opening image")
 		return err
 	}
-	imgs, err := client.Import(ctx, reader,
-		containerdApi.WithSkipDigestRef(func(name string) bool { return name != "" }),
-		containerdApi.WithDigestRef(archive.DigestTranslator(imageName)))
+	defer reader.Close()
+	// the image is named after the run rather than after the names of the archive,
+	// concurrent runs importing the same image would share those
+	index, err := archive.ImportIndex(ctx, client.ContentStore(), reader)
 	if err != nil {
 		logrus.Error("Error while Importing image")
 		return err
 	}
-	if len(imgs) == 0 {
-		logrus.Errorf("No images imported, imageTarPath: %s, outputTarPath: %s, imageName: %s \n", imageTarPath, outputTarPath, imageName)
-		return errors.New("image not imported from: " + imageTarPath)
-	}
-	image, err := client.GetImage(ctx, imgs[0].Name)
+	img, err := client.ImageService().Create(ctx, images.Image{
+		Name:   run.imageRef(),
+		Target: index,
+		Labels: run.labels,
+	})
 	if err != nil {
-		logrus.Error("Error while getting image from client")
+		logrus.Errorf("Error while creating image %s from %s", run.imageRef(), imageTarPath)
 		return err
 	}
-	rand.Seed(time.Now().UnixNano())
-	containerName := "temp" + fmt.Sprint(rand.Intn(9999))
+	defer func() {
+		cleanupCtx, cancel := utils.CleanupContext(ctx)
+		defer cancel()
+		if err := client.ImageService().Delete(cleanupCtx, img.Name); err != nil {
+			logrus.Warnf("Error while deleting image %s: %s", img.Name, err.Error())
+		}
+	}()
+	image := containerdApi.NewImage(client, img)
 	err = image.Unpack(ctx, "")
 	if err != nil {
 		logrus.Error("Error while unpacking image")
@@ -229,123 +414,533 @@ func (c Containerd) ExtractFileSystem(imageTarPath string, outputTarPath string,
 	}
 	container, err := client.NewContainer(
 		ctx,
-		containerName,
+		run.id,
 		containerdApi.WithImage(image),
-		containerdApi.WithNewSnapshot("temp"+fmt.Sprint(rand.Intn(9999)), image),
+		containerdApi.WithNewSnapshot(run.id, image, snapshots.WithLabels(run.labels)),
 		containerdApi.WithNewSpec(oci.WithImageConfig(image)),
+		containerdApi.WithContainerLabels(run.labels),
 	)
 	if err != nil {
 		logrus.Error("Error while creating container")
 		return err
 	}
-	info, _ := container.Info(ctx)
-	snapshotter := client.SnapshotService(info.Snapshotter)
-	mounts, err := snapshotter.Mounts(ctx, info.SnapshotKey)
+	defer func() {
+		cleanupCtx, cancel := utils.CleanupContext(ctx)
+		defer cancel()
+		if err := container.Delete(cleanupCtx, containerdApi.WithSnapshotCleanup); err != nil {
+			logrus.Warnf("Error while deleting container %s: %s", run.id, err.Error())
+		}
+	}()
+	info, err := container.Info(ctx)
 	if err != nil {
-		logrus.Errorf("Error mount snapshot %s: %s", info.SnapshotKey, err.Error())
-	}
-	target := strings.Replace(outputTarPath, ".tar", "", 1) + containerName
-	_, err = exec.Command("mkdir", target).Output()
-	if err != nil && !strings.Contains(err.Error(), "exit status 1") {
-		logrus.Errorf("Error while creating temp target dir %s: %s", target, err.Error())
+		logrus.Error("Error while getting container info")
 		return err
 	}
-	defer func() {
-		exec.Command("umount", target).Output()
-		exec.Command("rm", "-rf", target).Output()
-	}()
-	_, err = exec.Command("bash", "-c", fmt.Sprintf("mount -t %s %s %s -o %s\n", mounts[0].Type, mounts[0].Source, target, strings.Join(mounts[0].Options, ","))).Output()
+	snapshotter := client.SnapshotService(info.Snapshotter)
+	mounts, err := snapshotter.Mounts(ctx, info.SnapshotKey)
 	if err != nil {
-		logrus.Error("Error while mounting image on temp target dir")
+		logrus.Errorf("Error mount snapshot %s: %s", info.SnapshotKey, err.Error())
 		return err
 	}
-	_, err = exec.Command("tar", "-cvf", outputTarPath, "-C", target, ".").Output()
-	if !utils.CheckTarFileValid(outputTarPath) {
-		if err != nil {
-			logrus.Error("Error while packing tar")
+	return utils.WriteFileFunc(outputTarPath, func(w io.Writer) error {
+		if err := tarMounts(ctx, mounts, w); err != nil {
+			logrus.Errorf("Error while packing tar of snapshot %s: %s", info.SnapshotKey, err.Error())
 			return err
 		}
-	}
-	container.Delete(ctx, containerdApi.WithSnapshotCleanup)
-	client.ImageService().Delete(ctx, imgs[0].Name, images.SynchronousDelete())
-	return nil
+		return nil
+	})
 }
 
 // ExtractFileSystemContainer Extract the file system of an existing container to tar
 func (c Containerd) ExtractFileSystemContainer(containerId string, namespace string, outputTarPath string) error {
+	return c.ExtractFileSystemContainerContext(context.Background(), containerId, namespace, outputTarPath)
+}
+
+// ExtractFileSystemContainerContext Extract the file system of an existing container to tar
+func (c Containerd) ExtractFileSystemContainerContext(ctx context.Context, containerId string, namespace string, outputTarPath string) (err error) {
+	defer errdefs.Annotate(ctx, &err, utils.CONTAINERD, "export container", containerId, nil)
+	return utils.WriteFileFunc(outputTarPath, func(w io.Writer) error {
+		return c.ExportContainerTo(ctx, containerId, namespace, w)
+	})
+}
+
+// ExportContainerTo streams the file system of the snapshot of the container as a tar to w,
+// the container is searched like InspectContainer does when namespace is empty
+func (c Containerd) ExportContainerTo(ctx context.Context, containerId string, namespace string, w io.Writer) (err error) {
+	defer errdefs.Annotate(ctx, &err, utils.CONTAINERD, "export container", containerId, nil)
 	// create a new client connected to the default socket path for containerd
-	client, err := containerdApi.New(strings.Replace(c.socketPath, "unix://", "", 1))
+	client, err := c.newClient()
 	if err != nil {
 		return err
 	}
 	defer client.Close()
-	// create a new context with namespace
-	if len(namespace) == 0 {
-		namespace = utils.CONTAINERD_K8S_NS
-	}
-	ctx := namespaces.WithNamespace(context.Background(), namespace)
-	container, err := client.LoadContainer(ctx, containerId)
+	// the namespaces of the operation are searched when none is given
+	namespace, container, err := c.loadContainer(ctx, client, containerId, namespace)
 	if err != nil {
 		logrus.Error("Error while getting container")
 		return err
 	}
-	info, _ := container.Info(ctx)
+	ctx = namespaces.WithNamespace(ctx, namespace)
+	info, err := container.Info(ctx)
+	if err != nil {
+		logrus.Error("Error while getting container info")
+		return err
+	}
 	snapshotter := client.SnapshotService(info.Snapshotter)
 	mounts, err := snapshotter.Mounts(ctx, info.SnapshotKey)
 	if err != nil {
 		logrus.Errorf("Error mount snapshot %s: %s", info.SnapshotKey, err.Error())
+		return err
 	}
-	target := strings.Replace(outputTarPath, ".tar", "", 1) + containerId
-	_, err = exec.Command("mkdir", target).Output()
-	if err != nil && !strings.Contains(err.Error(), "exit status 1") {
-		logrus.Errorf("Error while creating temp target dir %s %s \n", target, err.Error())
+	if err := tarMounts(ctx, mounts, w); err != nil {
+		logrus.Errorf("Error while packing tar of snapshot %s: %s", info.SnapshotKey, err.Error())
 		return err
 	}
-	defer func() {
-		exec.Command("umount", target).Output()
-		exec.Command("rm", "-rf", target).Output()
-	}()
-	var mountStatement = fmt.Sprintf("mount -t %s %s %s -o %s\n", mounts[0].Type, mounts[0].Source, target, strings.Join(mounts[0].Options, ","))
-	cmd := exec.Command("bash", "-c", mountStatement)
-	logrus.Infof("mount command: %s", cmd.String())
-	_, err = cmd.Output()
-	if err != nil {
-		mountedHostPath := "/fenced/mnt/host"
-		logrus.Warnf("error while mounting image on temp target dir %s %s %s \n", mountStatement, " err: ", err.Error())
-		logrus.Infof("Reattempting mount from %s \n", mountedHostPath)
-		var containerdTmpDirs = []string{"/tmp", "/var/lib"}
-		var workDir, upperDir, lowerDir string
-		for index, option := range mounts[0].Options {
-			for _, tmpDir := range containerdTmpDirs {
-				if strings.Contains(option, tmpDir) {
-					mounts[0].Options[index] = strings.Replace(option, tmpDir, mountedHostPath+tmpDir, -1)
-					if strings.Index(mounts[0].Options[index], "upperdir") >= 0 {
-						upperDir = strings.Split(mounts[0].Options[index], "=")[1]
-					} else if strings.Index(mounts[0].Options[index], "workdir") >= 0 {
-						workDir = strings.Split(mounts[0].Options[index], "=")[1]
-					} else if strings.Index(mounts[0].Options[index], "lowerdir") >= 0 {
-						lowerDir = strings.Split(mounts[0].Options[index], "=")[1]
-					}
+	return nil
+}
+
+// tarMounts writes the tree the snapshot mounts show as a tar to w. Overlay and bind snapshots are read
+// straight from their directories, which needs neither mount(8) nor CAP_SYS_ADMIN unless the opaque
+// directories of a rootful overlay have to be told apart. The other snapshotters, and the rootful
+// overlays without CAP_SYS_ADMIN, are mounted read-only for the time of the tar and unmounted whatever happens.
+func tarMounts(ctx context.Context, mounts []mount.Mount, w io.Writer) error {
+	if len(mounts) == 1 {
+		if overlay, ok := utils.OverlayMount(mounts[0].Type, mounts[0].Source, mounts[0].Options); ok {
+			err := utils.TarOverlay(ctx, overlay, w)
+			if !errors.Is(err, utils.ErrOpaqueUnreadable) {
+				return err
+			}
+			// nothing was written yet
+			logrus.Infof("%s, mounting the snapshot instead", err.Error())
+		}
+	}
+	// the snapshot paths are host paths
+	hostMounts := slices.Clone(mounts)
+	for i, m := range hostMounts {
+		hostMounts[i].Options = utils.HostMountOptions(m.Options)
+		if m.Type == "bind" || m.Type == "rbind" {
+			hostMounts[i].Source = utils.HostPath(m.Source)
+		}
+	}
+	return mount.WithReadonlyTempMount(ctx, hostMounts, func(root string) error {
+		return utils.TarDirectory(ctx, root, w)
+	})
+}
+
+// ListContainers returns the containers of every namespace, the namespaces are listed afresh,
+// or of the namespace the runtime or ctx is restricted to
+func (c Containerd) ListContainers(ctx context.Context) (_ []types.Container, err error) {
+	defer errdefs.Annotate(ctx, &err, utils.CONTAINERD, "list containers", "", nil)
+	client, err := c.newClient()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	nsList, err := c.operationNamespaces(ctx, client, true)
+	if err != nil {
+		return nil, err
+	}
+	var containers []types.Container
+	for _, ns := range nsList {
+		nsCtx := namespaces.WithNamespace(ctx, ns)
+		nsContainers, err := client.Containers(nsCtx)
+		if err != nil {
+			return nil, fmt.Errorf("namespace: %s, err: %w", ns, err)
+		}
+		imageDigests := map[string]string{}
+		for _, container := range nsContainers {
+			info, err := container.Info(nsCtx, containerdApi.WithoutRefreshedMetadata)
+			if err != nil {
+				logrus.Warnf("namespace: %s, container %s info: %s", ns, container.ID(), err.Error())
+				continue
+			}
+			imageDigest, ok := imageDigests[info.Image]
+			if !ok && info.Image != "" {
+				if img, err := client.ImageService().Get(nsCtx, info.Image); err == nil {
+					imageDigest = img.Target.Digest.String()
 				}
+				imageDigests[info.Image] = imageDigest
 			}
+			record := types.Container{
+				ID:          info.ID,
+				Name:        containerName(info.ID, info.Labels),
+				Image:       info.Image,
+				ImageDigest: imageDigest,
+				State:       containerState(nsCtx, container),
+				Labels:      info.Labels,
+				Namespace:   ns,
+				Created:     info.CreatedAt,
+			}
+			record.SetPodFromLabels()
+			containers = append(containers, record)
 		}
-		mountStatement = fmt.Sprintf("mount -t %s %s %s -o index=off,lowerdir=%s \n",
-			mounts[0].Type, mounts[0].Source, target, workDir+":"+upperDir+":"+lowerDir)
-		cmd := exec.Command("bash", "-c", mountStatement)
-		logrus.Infof("mount command: %s", cmd.String())
-		_, err = cmd.Output()
+	}
+	return containers, nil
+}
+
+// containerName prefers the names nerdctl and the kubelet record in labels
+func containerName(id string, labels map[string]string) string {
+	for _, label := range []string{"nerdctl/name", types.ContainerNameLabel} {
+		if name := labels[label]; name != "" {
+			return name
+		}
+	}
+	return id
+}
+
+// containerState maps the status of the container task onto the normalized states,
+// a container without task has been created but never started
+func containerState(ctx context.Context, container containerdApi.Container) string {
+	task, err := container.Task(ctx, nil)
+	if err != nil {
+		if containerdErrdefs.IsNotFound(err) {
+			return types.ContainerStateCreated
+		}
+		return types.ContainerStateUnknown
+	}
+	status, err := task.Status(ctx)
+	if err != nil {
+		return types.ContainerStateUnknown
+	}
+	switch status.Status {
+	case containerdApi.Created:
+		return types.ContainerStateCreated
+	case containerdApi.Running:
+		return types.ContainerStateRunning
+	case containerdApi.Paused, containerdApi.Pausing:
+		return types.ContainerStatePaused
+	case containerdApi.Stopped:
+		return types.ContainerStateExited
+	}
+	return types.ContainerStateUnknown
+}
+
+// ListImages returns the images of every namespace or of the namespace the runtime or ctx is restricted to,
+// the names sharing a manifest are merged into one record
+func (c Containerd) ListImages(ctx context.Context) (_ []types.Image, err error) {
+	defer errdefs.Annotate(ctx, &err, utils.CONTAINERD, "list images", "", nil)
+	client, err := c.newClient()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	nsList, err := c.operationNamespaces(ctx, client, true)
+	if err != nil {
+		return nil, err
+	}
+	var result []types.Image
+	for _, ns := range nsList {
+		nsCtx := namespaces.WithNamespace(ctx, ns)
+		imgs, err := client.ImageService().List(nsCtx)
 		if err != nil {
-			logrus.Errorf("error while mounting image on temp target dir 2nd attempt %s %s %s \n", mountStatement, " err: ", err.Error())
-			return err
+			return nil, fmt.Errorf("namespace: %s, err: %w", ns, err)
+		}
+		byTarget := map[string]*types.Image{}
+		var order []string
+		for _, img := range imgs {
+			target := img.Target.Digest.String()
+			record, ok := byTarget[target]
+			if !ok {
+				record = &types.Image{ID: target, Namespace: ns, Created: img.CreatedAt}
+				c.describeImage(nsCtx, client, img, record)
+				byTarget[target] = record
+				order = append(order, target)
+			}
+			addImageName(record, img.Name)
+		}
+		for _, target := range order {
+			result = append(result, *byTarget[target])
+		}
+	}
+	return result, nil
+}
+
+// addImageName files the containerd image name as a repo tag or repo digest,
+// the names made of a bare digest are the ids the CRI plugin records
+func addImageName(record *types.Image, name string) {
+	if _, err := digest.Parse(name); err == nil {
+		return
+	}
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return
+	}
+	if _, ok := named.(reference.Digested); ok {
+		record.RepoDigests = append(record.RepoDigests, name)
+		return
+	}
+	record.RepoTags = append(record.RepoTags, name)
+	record.RepoDigests = append(record.RepoDigests, named.Name()+"@"+record.ID)
+}
+
+// describeImage fills the config digest, size, creation time and platform from the content store,
+// they stay empty when the content for the host platform is missing
+func (c Containerd) describeImage(ctx context.Context, client *containerdApi.Client, img images.Image, record *types.Image) {
+	configDesc, config, err := imageConfig(ctx, client, img)
+	if err != nil {
+		logrus.Debugf("image %s config: %s", img.Name, err.Error())
+		return
+	}
+	record.ConfigDigest = configDesc.Digest.String()
+	image := containerdApi.NewImageWithPlatform(client, img, platforms.Default())
+	if size, err := image.Size(ctx); err == nil {
+		record.Size = size
+	}
+	if config.Created != nil {
+		record.Created = *config.Created
+	}
+	record.Platform = platforms.Format(config.Platform)
+}
+
+// imageConfig reads the config of the host platform image from the content store
+func imageConfig(ctx context.Context, client *containerdApi.Client, img images.Image) (ocispec.Descriptor, *ocispec.Image, error) {
+	image := containerdApi.NewImageWithPlatform(client, img, platforms.Default())
+	configDesc, err := image.Config(ctx)
+	if err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+	configData, err := content.ReadBlob(ctx, client.ContentStore(), configDesc)
+	if err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+	var config ocispec.Image
+	if err := json.Unmarshal(configData, &config); err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+	return configDesc, &config, nil
+}
+
+// InspectImage returns the config, layers and history of the image from the first namespace holding it
+func (c Containerd) InspectImage(ctx context.Context, imageName string) (_ *types.ImageInspect, err error) {
+	defer errdefs.Annotate(ctx, &err, utils.CONTAINERD, "inspect image", imageName, nil)
+	client, err := c.newClient()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	found, searched, err := c.findImages(ctx, client, imageName)
+	if err != nil {
+		return nil, err
+	}
+	if len(found) == 0 {
+		return nil, fmt.Errorf("%w: %s in namespaces %v", errdefs.ErrImageNotFound, imageName, searched)
+	}
+	img, ns := found[0].image, found[0].namespace
+	nsCtx := namespaces.WithNamespace(ctx, ns)
+	result := &types.ImageInspect{
+		Image: types.Image{ID: img.Target.Digest.String(), Namespace: ns, Created: img.CreatedAt},
+	}
+	// every name pointing at the same manifest in the namespace is a tag or digest of the image
+	siblings, err := client.ImageService().List(nsCtx)
+	if err != nil {
+		return nil, fmt.Errorf("namespace: %s, err: %w", ns, err)
+	}
+	for _, sibling := range siblings {
+		if sibling.Target.Digest == img.Target.Digest {
+			addImageName(&result.Image, sibling.Name)
 		}
-		logrus.Info("mount success \n")
 	}
-	_, err = exec.Command("tar", "-cvf", outputTarPath, "-C", target, ".").Output()
-	if !utils.CheckTarFileValid(outputTarPath) {
+	configDesc, config, err := imageConfig(nsCtx, client, img)
+	if err != nil {
+		return nil, fmt.Errorf("image %s config: %w", imageName, err)
+	}
+	result.ConfigDigest = configDesc.Digest.String()
+	if size, err := containerdApi.NewImageWithPlatform(client, img, platforms.Default()).Size(nsCtx); err == nil {
+		result.Size = size
+	}
+	result.SetFromOCIConfig(*config)
+	return result, nil
+}
+
+const (
+	// taskRootFS is where the shim of a running task mounts the root filesystem of the container,
+	// below the state directory of containerd
+	taskRootFS = "io.containerd.runtime.v2.task/%s/%s/rootfs"
+	// defaultStateDir is the state directory of containerd when its config does not set one
+	defaultStateDir = "/run/containerd"
+)
+
+// criSandboxAnnotation is set by the CRI plugin on the spec of every kubernetes container
+const criSandboxAnnotation = "io.kubernetes.cri.sandbox-id"
+
+// InspectContainer returns the rootfs, snapshot, mounts and process details of the container,
+// every namespace, or the one the runtime or ctx is restricted to, is searched when namespace is empty
+func (c Containerd) InspectContainer(ctx context.Context, containerId string, namespace string) (_ *types.ContainerInspect, err error) {
+	defer errdefs.Annotate(ctx, &err, utils.CONTAINERD, "inspect container", containerId, nil)
+	client, err := c.newClient()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	ns, container, err := c.loadContainer(ctx, client, containerId, namespace)
+	if err != nil {
+		return nil, err
+	}
+	return c.inspectContainer(namespaces.WithNamespace(ctx, ns), client, ns, container)
+}
+
+func (c Containerd) inspectContainer(ctx context.Context, client *containerdApi.Client, namespace string, container containerdApi.Container) (*types.ContainerInspect, error) {
+	info, err := container.Info(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("container %s info: %w", container.ID(), err)
+	}
+	result := &types.ContainerInspect{
+		Container: types.Container{
+			ID:        info.ID,
+			Name:      containerName(info.ID, info.Labels),
+			Image:     info.Image,
+			State:     containerState(ctx, container),
+			Labels:    info.Labels,
+			Namespace: namespace,
+			Created:   info.CreatedAt,
+		},
+		Snapshotter: info.Snapshotter,
+		SnapshotKey: info.SnapshotKey,
+	}
+	if info.Image != "" {
+		if img, err := client.ImageService().Get(ctx, info.Image); err == nil {
+			result.ImageDigest = img.Target.Digest.String()
+		}
+	}
+	if info.SnapshotKey != "" {
+		mounts, err := client.SnapshotService(info.Snapshotter).Mounts(ctx, info.SnapshotKey)
 		if err != nil {
-			logrus.Errorf("Error while packing tar %s %s %s \n", outputTarPath, target, err.Error())
-			return err
+			logrus.Warnf("container %s snapshot %s mounts: %s", info.ID, info.SnapshotKey, err.Error())
+		} else if len(mounts) > 0 {
+			result.StorageData = map[string]string{"type": mounts[0].Type, "source": mounts[0].Source}
+			for _, option := range mounts[0].Options {
+				key, value, _ := strings.Cut(option, "=")
+				result.StorageData[key] = value
+			}
 		}
 	}
-	return nil
+	if task, err := container.Task(ctx, nil); err == nil {
+		result.Pid = int(task.Pid())
+		// the shim unmounts the root filesystem once the task stops
+		if status, err := task.Status(ctx); err == nil && status.Status == containerdApi.Running {
+			result.RootFS = utils.HostPath(path.Join(c.stateDir(ctx, client), fmt.Sprintf(taskRootFS, namespace, info.ID)))
+		}
+	}
+	spec, err := container.Spec(ctx)
+	if err != nil {
+		logrus.Warnf("container %s spec: %s", info.ID, err.Error())
+	} else {
+		if spec.Process != nil {
+			result.Env = spec.Process.Env
+		}
+		if spec.Linux != nil {
+			result.CgroupPath = spec.Linux.CgroupsPath
+		}
+		for _, m := range spec.Mounts {
+			result.Mounts = append(result.Mounts, types.Mount{
+				Type:        m.Type,
+				Source:      m.Source,
+				Destination: m.Destination,
+				Options:     m.Options,
+				ReadOnly:    slices.Contains(m.Options, "ro"),
+			})
+		}
+		result.SandboxID = spec.Annotations[criSandboxAnnotation]
+	}
+	if result.Pid > 0 {
+		if cgroupPath := utils.CgroupPath(result.Pid); cgroupPath != "" {
+			result.CgroupPath = cgroupPath
+		}
+	}
+	result.SetPodFromLabels()
+	return result, nil
+}
+
+// criConfig is the part of the CRI plugin config describing the snapshotter, the cgroup driver and the root
+type criConfig struct {
+	Containerd struct {
+		Snapshotter        string `json:"snapshotter"`
+		DefaultRuntimeName string `json:"defaultRuntimeName"`
+		Runtimes           map[string]struct {
+			Options struct {
+				SystemdCgroup bool `json:"SystemdCgroup"`
+			} `json:"options"`
+		} `json:"runtimes"`
+	} `json:"containerd"`
+	ContainerdRootDir string `json:"containerdRootDir"`
+	// StateDir is the state directory of the CRI plugin, below the one of containerd
+	StateDir string `json:"stateDir"`
+}
+
+// readCRIConfig returns the config the CRI plugin reports in its verbose status
+func readCRIConfig(ctx context.Context, criRuntime runtimeapi.RuntimeServiceClient) (*criConfig, error) {
+	status, err := criRuntime.Status(ctx, &runtimeapi.StatusRequest{Verbose: true})
+	if err != nil {
+		return nil, err
+	}
+	var config criConfig
+	if err := json.Unmarshal([]byte(status.GetInfo()["config"]), &config); err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// stateDir returns the state directory of containerd, /run/k3s/containerd for k3s and RKE2 or
+// /var/snap/microk8s/common/run/containerd for microk8s, from the state directory of the CRI plugin.
+// Without the CRI plugin the directory of the socket is tried, then the default.
+func (c Containerd) stateDir(ctx context.Context, client *containerdApi.Client) string {
+	config, err := readCRIConfig(ctx, runtimeapi.NewRuntimeServiceClient(client.Conn()))
+	if err == nil && config.StateDir != "" {
+		return path.Dir(config.StateDir)
+	}
+	socketDir := path.Dir(strings.Replace(c.socketPath, "unix://", "", 1))
+	for _, dir := range []string{socketDir, path.Join(socketDir, "containerd")} {
+		if _, err := os.Stat(utils.HostPath(path.Join(dir, "io.containerd.runtime.v2.task"))); err == nil {
+			return dir
+		}
+	}
+	return defaultStateDir
+}
+
+// Info returns the version, snapshotter, cgroup driver, root and platform of containerd,
+// the CRI API version, the snapshotter, the cgroup driver and the root come from the CRI plugin when it is enabled
+func (c Containerd) Info(ctx context.Context) (_ *types.RuntimeInfo, err error) {
+	defer errdefs.Annotate(ctx, &err, utils.CONTAINERD, "info", "", nil)
+	client, err := c.newClient()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	version, err := client.Version(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("containerd version: %w", err)
+	}
+	// containerd does not report its platform, it runs on the host vessel talks to over the socket
+	platform := platforms.DefaultSpec()
+	info := &types.RuntimeInfo{
+		Runtime:       utils.CONTAINERD,
+		Endpoint:      c.socketPath,
+		Version:       version.Version,
+		StorageDriver: containerdApi.DefaultSnapshotter,
+		CgroupDriver:  "cgroupfs",
+		CgroupVersion: utils.CgroupVersion(),
+		OS:            platform.OS,
+		Architecture:  platform.Architecture,
+	}
+	conn := client.Conn()
+	criRuntime := runtimeapi.NewRuntimeServiceClient(conn)
+	criVersion, err := criRuntime.Version(ctx, &runtimeapi.VersionRequest{})
+	if err != nil {
+		logrus.Debugf("containerd cri plugin not available: %s", err)
+		return info, nil
+	}
+	info.APIVersion = criVersion.RuntimeApiVersion
+	config, err := readCRIConfig(ctx, criRuntime)
+	if err != nil {
+		logrus.Debugf("containerd cri config: %s", err)
+		return info, nil
+	}
+	if config.Containerd.Snapshotter != "" {
+		info.StorageDriver = config.Containerd.Snapshotter
+	}
+	if config.Containerd.Runtimes[config.Containerd.DefaultRuntimeName].Options.SystemdCgroup {
+		info.CgroupDriver = "systemd"
+	}
+	info.RootDir = config.ContainerdRootDir
+	return info, nil
 }
@@ -0,0 +1,149 @@
+package containerd
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	containerdApi "github.com/containerd/containerd"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/deepfence/vessel/errdefs"
+	"github.com/deepfence/vessel/utils"
+)
+
+// WithNamespace returns a copy of the runtime whose operations are restricted to namespace,
+// "" searches every namespace again. A namespace set on the context of a call with
+// namespaces.WithNamespace takes precedence, the namespace argument of the container operations as well.
+func (c Containerd) WithNamespace(namespace string) *Containerd {
+	c.namespace = namespace
+	return &c
+}
+
+// Namespace returns the namespace the operations are restricted to, empty when they search every namespace
+func (c Containerd) Namespace() string {
+	return c.namespace
+}
+
+// Namespaces returns the namespaces of containerd as last listed, they are listed on the first call.
+// TempNamespace is left out, its scratch resources are only seen by the calls scoped to it.
+func (c Containerd) Namespaces(ctx context.Context) (_ []string, err error) {
+	defer errdefs.Annotate(ctx, &err, utils.CONTAINERD, "list namespaces", "", nil)
+	client, err := c.newClient()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	names, err := c.cachedNamespaces(ctx, client)
+	return slices.Clone(names), err
+}
+
+// RefreshNamespaces lists the namespaces of containerd afresh, the ones created since they were last listed
+// are then searched too. The list is refreshed as well when an image or a container is found nowhere.
+func (c Containerd) RefreshNamespaces(ctx context.Context) (_ []string, err error) {
+	defer errdefs.Annotate(ctx, &err, utils.CONTAINERD, "list namespaces", "", nil)
+	client, err := c.newClient()
+	if err != nil {
+		return nil, err
+	}
+	defer client.Close()
+	names, err := c.refreshNamespaces(ctx, client)
+	return slices.Clone(names), err
+}
+
+// ImageNamespace returns the first namespace holding the image given as a tag, a digest or an id
+func (c Containerd) ImageNamespace(ctx context.Context, imageName string) (string, error) {
+	location, err := c.LookupImage(ctx, imageName)
+	if err != nil {
+		return "", err
+	}
+	if location == nil {
+		return "", errdefs.New(errdefs.ErrImageNotFound, utils.CONTAINERD, "lookup image", imageName)
+	}
+	return location.Namespaces[0], nil
+}
+
+// ContainerNamespace returns the namespace holding the container
+func (c Containerd) ContainerNamespace(ctx context.Context, containerId string) (_ string, err error) {
+	defer errdefs.Annotate(ctx, &err, utils.CONTAINERD, "lookup container", containerId, nil)
+	client, err := c.newClient()
+	if err != nil {
+		return "", err
+	}
+	defer client.Close()
+	ns, _, err := c.loadContainer(ctx, client, containerId, "")
+	return ns, err
+}
+
+func (c Containerd) cachedNamespaces(ctx context.Context, client *containerdApi.Client) ([]string, error) {
+	if names := c.namespaces.get(); len(names) > 0 {
+		return names, nil
+	}
+	return c.refreshNamespaces(ctx, client)
+}
+
+func (c Containerd) refreshNamespaces(ctx context.Context, client *containerdApi.Client) ([]string, error) {
+	names, err := client.NamespaceService().List(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("list namespaces: %w", err)
+	}
+	names = searchedNamespaces(names)
+	c.namespaces.set(names)
+	return names, nil
+}
+
+// searchedNamespaces drops from names the namespaces the operations spanning every namespace skip:
+// TempNamespace, whose images and containers only live for a run of ExtractFileSystem or were left by a crashed one
+func searchedNamespaces(names []string) []string {
+	return slices.DeleteFunc(names, func(ns string) bool {
+		return ns == TempNamespace
+	})
+}
+
+// scope returns the one namespace an operation is restricted to: the namespace of ctx, else the namespace of the runtime
+func (c Containerd) scope(ctx context.Context) string {
+	if ns, ok := namespaces.Namespace(ctx); ok {
+		return ns
+	}
+	return c.namespace
+}
+
+// operationNamespaces returns the namespaces an operation spanning every namespace walks, listed afresh when fresh is set
+func (c Containerd) operationNamespaces(ctx context.Context, client *containerdApi.Client, fresh bool) ([]string, error) {
+	if ns := c.scope(ctx); ns != "" {
+		return []string{ns}, nil
+	}
+	if fresh {
+		return c.refreshNamespaces(ctx, client)
+	}
+	return c.cachedNamespaces(ctx, client)
+}
+
+// searchNamespaces calls search with the namespaces to look into until it finds what it looks for,
+// the cached namespaces first then the ones created since they were listed. It returns the namespaces searched.
+func (c Containerd) searchNamespaces(ctx context.Context, client *containerdApi.Client, search func(nsList []string) (bool, error)) ([]string, error) {
+	if ns := c.scope(ctx); ns != "" {
+		_, err := search([]string{ns})
+		return []string{ns}, err
+	}
+	cached, err := c.cachedNamespaces(ctx, client)
+	if err != nil {
+		return nil, err
+	}
+	if found, err := search(cached); found || err != nil {
+		return cached, err
+	}
+	fresh, err := c.refreshNamespaces(ctx, client)
+	if err != nil {
+		return cached, err
+	}
+	var added []string
+	for _, ns := range fresh {
+		if !slices.Contains(cached, ns) {
+			added = append(added, ns)
+		}
+	}
+	if len(added) > 0 {
+		_, err = search(added)
+	}
+	return fresh, err
+}
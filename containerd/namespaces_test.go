@@ -0,0 +1,45 @@
+package containerd
+
+import (
+	"context"
+	"slices"
+	"testing"
+
+	"github.com/containerd/containerd/namespaces"
+)
+
+func TestZeroValueNamespaces(t *testing.T) {
+	var c Containerd
+	c.namespaces.set([]string{"default"})
+	if names := c.namespaces.get(); names != nil {
+		t.Fatalf("zero value cached %v", names)
+	}
+	if ns := c.WithNamespace("k8s.io").scope(context.Background()); ns != "k8s.io" {
+		t.Fatalf("scope %q, want k8s.io", ns)
+	}
+}
+
+func TestNamespacesSharedByCopies(t *testing.T) {
+	c := Containerd{namespaces: &namespaceList{}}
+	scoped := c.WithNamespace("k8s.io")
+	c.namespaces.set([]string{"default", "k8s.io"})
+	if names := scoped.namespaces.get(); !slices.Equal(names, []string{"default", "k8s.io"}) {
+		t.Fatalf("copy sees %v", names)
+	}
+	ctx := namespaces.WithNamespace(context.Background(), "moby")
+	if ns := scoped.scope(ctx); ns != "moby" {
+		t.Fatalf("scope %q, want the namespace of the context", ns)
+	}
+}
+
+func TestSearchedNamespaces(t *testing.T) {
+	names := searchedNamespaces([]string{"default", TempNamespace, "k8s.io"})
+	if !slices.Equal(names, []string{"default", "k8s.io"}) {
+		t.Fatalf("searched %v", names)
+	}
+	c := Containerd{namespaces: &namespaceList{}}
+	ctx := namespaces.WithNamespace(context.Background(), TempNamespace)
+	if ns := c.scope(ctx); ns != TempNamespace {
+		t.Fatalf("scope %q, want %s when asked explicitly", ns, TempNamespace)
+	}
+}
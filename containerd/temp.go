@@ -0,0 +1,170 @@
+package containerd
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	containerdApi "github.com/containerd/containerd"
+	"github.com/containerd/containerd/leases"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/snapshots"
+	"github.com/deepfence/vessel/errdefs"
+	"github.com/deepfence/vessel/utils"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// TempNamespace holds the images, containers and snapshots ExtractFileSystem creates for the time of a run
+	TempNamespace = "vessel-temp"
+	// TempLabel marks the temporary resources, its value is the id of the run which created them
+	TempLabel = "vessel.deepfence.io/temporary"
+	// TempCreatedLabel records when, in RFC 3339, the temporary resources were created
+	TempCreatedLabel = "vessel.deepfence.io/created"
+	// TempLeaseExpiration bounds how long containerd keeps the content and snapshots of a run
+	// which neither finished nor was cleaned up
+	TempLeaseExpiration = 24 * time.Hour
+	// tempImageRepo prefixes the names of the temporary images, they can not clash with pulled images
+	tempImageRepo = "vessel.local/temp/"
+)
+
+// tempRun names and labels the temporary resources of one run
+type tempRun struct {
+	id     string
+	labels map[string]string
+}
+
+// newTempRun draws a unique id, names from rand.Intn would collide between concurrent runs
+func newTempRun() (tempRun, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return tempRun{}, err
+	}
+	id := "vessel-" + hex.EncodeToString(b)
+	return tempRun{
+		id: id,
+		labels: map[string]string{
+			TempLabel:        id,
+			TempCreatedLabel: time.Now().UTC().Format(time.RFC3339),
+		},
+	}, nil
+}
+
+// imageRef is the name of the image imported by the run
+func (r tempRun) imageRef() string {
+	return tempImageRepo + r.id + ":latest"
+}
+
+// tempFilter selects the resources carrying TempLabel
+var tempFilter = fmt.Sprintf("labels.%q", TempLabel)
+
+// createdBefore tells whether the resource was created before cutoff, from TempCreatedLabel else from created
+func createdBefore(labels map[string]string, created time.Time, cutoff time.Time) bool {
+	if value, ok := labels[TempCreatedLabel]; ok {
+		if t, err := time.Parse(time.RFC3339, value); err == nil {
+			created = t
+		}
+	}
+	return created.Before(cutoff)
+}
+
+// CleanupTemporaryResources removes what the runs of ExtractFileSystem left in TempNamespace when they crashed:
+// the containers, images, snapshots and leases carrying TempLabel created more than olderThan ago.
+// Keep olderThan above the duration of a run, running ones would lose their resources.
+// It returns how many resources were removed, the failures do not stop the collection.
+func (c Containerd) CleanupTemporaryResources(ctx context.Context, olderThan time.Duration) (removed int, err error) {
+	defer errdefs.Annotate(ctx, &err, utils.CONTAINERD, "cleanup temporary resources", "", nil)
+	client, err := c.newClient()
+	if err != nil {
+		return 0, err
+	}
+	defer client.Close()
+	ctx = namespaces.WithNamespace(ctx, TempNamespace)
+	cutoff := time.Now().Add(-olderThan)
+	var failures []error
+	fail := func(kind, name string, err error) {
+		logrus.Warnf("cleanup temporary %s %s: %s", kind, name, err.Error())
+		failures = append(failures, fmt.Errorf("%s %s: %w", kind, name, err))
+	}
+
+	containers, err := client.Containers(ctx, tempFilter)
+	if err != nil {
+		return 0, fmt.Errorf("list temporary containers: %w", err)
+	}
+	snapshotters := map[string]bool{containerdApi.DefaultSnapshotter: true}
+	for _, container := range containers {
+		info, err := container.Info(ctx, containerdApi.WithoutRefreshedMetadata)
+		if err != nil {
+			fail("container", container.ID(), err)
+			continue
+		}
+		snapshotters[info.Snapshotter] = true
+		if !createdBefore(info.Labels, info.CreatedAt, cutoff) {
+			continue
+		}
+		if err := container.Delete(ctx, containerdApi.WithSnapshotCleanup); err != nil {
+			fail("container", info.ID, err)
+			continue
+		}
+		removed++
+	}
+
+	imgs, err := client.ImageService().List(ctx, tempFilter)
+	if err != nil {
+		return removed, fmt.Errorf("list temporary images: %w", err)
+	}
+	for _, img := range imgs {
+		if !createdBefore(img.Labels, img.CreatedAt, cutoff) {
+			continue
+		}
+		if err := client.ImageService().Delete(ctx, img.Name); err != nil {
+			fail("image", img.Name, err)
+			continue
+		}
+		removed++
+	}
+
+	for snapshotter := range snapshotters {
+		var keys []string
+		err := client.SnapshotService(snapshotter).Walk(ctx, func(ctx context.Context, info snapshots.Info) error {
+			if createdBefore(info.Labels, info.Created, cutoff) {
+				keys = append(keys, info.Name)
+			}
+			return nil
+		}, tempFilter)
+		if err != nil {
+			fail("snapshots of", snapshotter, err)
+			continue
+		}
+		for _, key := range keys {
+			if err := client.SnapshotService(snapshotter).Remove(ctx, key); err != nil {
+				fail("snapshot", key, err)
+				continue
+			}
+			removed++
+		}
+	}
+
+	// the content and the snapshots the leases held are collected with them
+	leaseList, err := client.LeasesService().List(ctx, tempFilter)
+	if err != nil {
+		return removed, fmt.Errorf("list temporary leases: %w", err)
+	}
+	for _, lease := range leaseList {
+		if !createdBefore(lease.Labels, lease.CreatedAt, cutoff) {
+			continue
+		}
+		if err := client.LeasesService().Delete(ctx, lease, leases.SynchronousDelete); err != nil {
+			fail("lease", lease.ID, err)
+			continue
+		}
+		removed++
+	}
+	if len(failures) > 0 {
+		return removed, fmt.Errorf("%d temporary resources not removed: %w", len(failures), errors.Join(failures...))
+	}
+	return removed, nil
+}
@@ -1,6 +1,36 @@
 package containerd
 
+import "sync"
+
+// Containerd is the runtime backend talking to the containerd socket through its client
 type Containerd struct {
 	socketPath string
-	namespaces []string
+	// namespace restricts the operations to one namespace, every namespace is searched when empty
+	namespace  string
+	namespaces *namespaceList
+}
+
+// namespaceList caches the namespaces of containerd, it is shared by the copies of a Containerd.
+// A Containerd not made by New has none, its namespaces are then listed on every call.
+type namespaceList struct {
+	mu    sync.Mutex
+	names []string
+}
+
+func (l *namespaceList) get() []string {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.names
+}
+
+func (l *namespaceList) set(names []string) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.names = names
 }
@@ -0,0 +1,202 @@
+package crio
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/deepfence/vessel/errdefs"
+	"github.com/deepfence/vessel/utils"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	specs "github.com/opencontainers/runtime-spec/specs-go"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+// containerInfo is the verbose info CRI-O attaches to a container status
+type containerInfo struct {
+	SandboxID   string      `json:"sandboxID"`
+	Pid         int         `json:"pid"`
+	RuntimeSpec *specs.Spec `json:"runtimeSpec"`
+}
+
+// imageInfo is the verbose info CRI-O attaches to an image status
+type imageInfo struct {
+	ImageSpec *ocispec.Image `json:"imageSpec"`
+}
+
+// defaultRunRoot is the runroot of CRI-O when its configuration does not set one
+const defaultRunRoot = "/run/containers/storage"
+
+// daemonInfo is the answer of the CRI-O /info endpoint
+type daemonInfo struct {
+	StorageDriver string `json:"storage_driver"`
+	StorageRoot   string `json:"storage_root"`
+	CgroupDriver  string `json:"cgroup_driver"`
+}
+
+// newConnection dials the CRI gRPC server behind the socket
+func (c CRIO) newConnection() (*grpc.ClientConn, error) {
+	conn, err := utils.NewGRPCClient(c.socketPath)
+	if err != nil {
+		return nil, fmt.Errorf("could not connect to endpoint '%s': %w", c.socketPath, err)
+	}
+	return conn, nil
+}
+
+// imageStatus returns the image CRI-O resolves imageName to, nil if CRI-O does not have it
+func (c CRIO) imageStatus(ctx context.Context, imageName string) (*runtimeapi.Image, error) {
+	conn, err := c.newConnection()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	img, _, err := imageStatus(ctx, runtimeapi.NewImageServiceClient(conn), imageName, false)
+	return img, err
+}
+
+// imageStatus queries the image service, the verbose info is only decoded when asked for
+func imageStatus(ctx context.Context, images runtimeapi.ImageServiceClient, imageName string, verbose bool) (*runtimeapi.Image, *imageInfo, error) {
+	resp, err := images.ImageStatus(ctx, &runtimeapi.ImageStatusRequest{
+		Image:   &runtimeapi.ImageSpec{Image: imageName},
+		Verbose: verbose,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("image status %s: %w", imageName, err)
+	}
+	info := &imageInfo{}
+	if raw, ok := resp.GetInfo()["info"]; ok {
+		if err := json.Unmarshal([]byte(raw), info); err != nil {
+			return nil, nil, fmt.Errorf("image status %s: invalid info: %w", imageName, err)
+		}
+	}
+	return resp.GetImage(), info, nil
+}
+
+// containerStatus returns the CRI status of the container along with the CRI-O verbose info
+func (c CRIO) containerStatus(ctx context.Context, containerId string) (*runtimeapi.ContainerStatus, *containerInfo, error) {
+	conn, err := c.newConnection()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	resp, err := runtimeapi.NewRuntimeServiceClient(conn).ContainerStatus(ctx, &runtimeapi.ContainerStatusRequest{
+		ContainerId: containerId,
+		Verbose:     true,
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("container status %s: %w", containerId, err)
+	}
+	info := &containerInfo{}
+	if raw, ok := resp.GetInfo()["info"]; ok {
+		if err := json.Unmarshal([]byte(raw), info); err != nil {
+			return nil, nil, fmt.Errorf("container status %s: invalid info: %w", containerId, err)
+		}
+	}
+	return resp.GetStatus(), info, nil
+}
+
+// get queries the CRI-O http API served on the same socket as the CRI
+func (c CRIO) get(ctx context.Context, path string) ([]byte, error) {
+	addr, dialer, err := utils.GetAddressAndDialer(c.socketPath)
+	if err != nil {
+		return nil, err
+	}
+	httpClient := http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dialer(ctx, addr)
+			},
+		},
+		Timeout: utils.Timeout,
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://crio"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		err := errors.New("crio " + path + ": " + resp.Status)
+		switch resp.StatusCode {
+		case http.StatusNotFound:
+			// older CRI-O releases do not serve every endpoint
+			return nil, &errdefs.Error{Kind: errdefs.ErrNotImplemented, Runtime: utils.CRIO, Op: "get", Subject: path, Err: err}
+		case http.StatusUnauthorized, http.StatusForbidden:
+			return nil, &errdefs.Error{Kind: errdefs.ErrPermissionDenied, Runtime: utils.CRIO, Op: "get", Subject: path, Err: err}
+		}
+		return nil, errdefs.Wrap(utils.CRIO, "get", path, nil, err)
+	}
+	return io.ReadAll(resp.Body)
+}
+
+// daemonInfo queries the CRI-O /info endpoint for its storage and cgroup configuration
+func (c CRIO) daemonInfo(ctx context.Context) (*daemonInfo, error) {
+	body, err := c.get(ctx, "/info")
+	if err != nil {
+		return nil, err
+	}
+	info := &daemonInfo{}
+	if err := json.Unmarshal(body, info); err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// runRoot returns the runroot of the CRI-O store, holding its locks and mount state, from the
+// configuration CRI-O serves on /config, the default of CRI-O when it can not be read
+func (c CRIO) runRoot(ctx context.Context) string {
+	config, err := c.get(ctx, "/config")
+	if err != nil {
+		logrus.Debugf("crio config not available, assuming runroot %s: %s", defaultRunRoot, err)
+		return defaultRunRoot
+	}
+	for _, line := range strings.Split(string(config), "\n") {
+		key, value, ok := strings.Cut(strings.TrimSpace(line), "=")
+		if !ok || strings.TrimSpace(key) != "runroot" {
+			continue
+		}
+		if runRoot, err := strconv.Unquote(strings.TrimSpace(value)); err == nil && runRoot != "" {
+			return runRoot
+		}
+	}
+	return defaultRunRoot
+}
+
+// storageArgs returns the podman global flags pointing at the CRI-O image store. Podman takes the
+// locks of CRI-O only when given its runroot too, its own would let both write the store at once.
+func (c CRIO) storageArgs(ctx context.Context) []string {
+	info, err := c.daemonInfo(ctx)
+	if err != nil {
+		logrus.Debugf("crio storage info not available, using podman defaults: %s", err)
+		return nil
+	}
+	if info.StorageRoot == "" {
+		return nil
+	}
+	args := []string{"--root", utils.HostPath(info.StorageRoot), "--runroot", utils.HostPath(c.runRoot(ctx))}
+	if info.StorageDriver != "" {
+		args = append(args, "--storage-driver", info.StorageDriver)
+	}
+	return args
+}
+
+// podmanCommand prepares podman against the CRI-O store, the CRI offers no way to read the content of images
+func (c CRIO) podmanCommand(ctx context.Context, op string, args ...string) (*exec.Cmd, error) {
+	path, err := exec.LookPath("podman")
+	if err != nil {
+		return nil, &errdefs.Error{Kind: errdefs.ErrToolMissing, Runtime: utils.CRIO, Op: op, Subject: "podman", Err: err}
+	}
+	return exec.CommandContext(ctx, path, append(c.storageArgs(ctx), args...)...), nil
+}
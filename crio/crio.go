@@ -1,14 +1,25 @@
 package crio
 
 import (
+	"context"
 	"errors"
-	"os/exec"
+	"fmt"
+	"io"
+	"slices"
 	"strings"
+	"time"
 
+	"github.com/containerd/platforms"
+	"github.com/deepfence/vessel/errdefs"
+	"github.com/deepfence/vessel/types"
 	"github.com/deepfence/vessel/utils"
 	"github.com/sirupsen/logrus"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
 )
 
+// imageNameAnnotation is set by CRI-O on containers to the image name from the pod spec
+const imageNameAnnotation = "io.kubernetes.cri-o.ImageName"
+
 // New instantiates a new CRIO runtime object
 func New(host string) *CRIO {
 	return &CRIO{
@@ -22,16 +33,73 @@ func (c CRIO) GetSocket() string {
 
 // ImageExists checks if the image exists
 func (c CRIO) ImageExists(imageName string) bool {
-	_, err := exec.Command("podman", "inspect", imageName).Output()
+	return c.ImageExistsContext(context.Background(), imageName)
+}
+
+// ImageExistsContext checks if the image exists using the CRI image service,
+// CRI-O failing to answer is logged and reported as missing
+func (c CRIO) ImageExistsContext(ctx context.Context, imageName string) bool {
+	location, err := c.LookupImage(ctx, imageName)
+	if err != nil {
+		logrus.Debug(err.Error())
+	}
+	return location != nil
+}
+
+// LookupImage asks the CRI image service for the image by name, id or digest,
+// the store is the storage root of CRI-O
+func (c CRIO) LookupImage(ctx context.Context, imageName string) (_ *types.ImageLocation, err error) {
+	defer errdefs.Annotate(ctx, &err, utils.CRIO, "lookup image", imageName, errdefs.ErrImageNotFound)
+	img, err := c.imageStatus(ctx, imageName)
 	if err != nil {
-		return false
+		return nil, err
+	}
+	if img == nil {
+		return nil, nil
+	}
+	location := &types.ImageLocation{ID: img.Id}
+	if info, err := c.daemonInfo(ctx); err == nil {
+		location.Store = info.StorageRoot
+	}
+	return location, nil
+}
+
+// resolveImage returns the reference podman should use to read the image CRI-O knows as imageName
+func (c CRIO) resolveImage(ctx context.Context, imageName string) (string, error) {
+	img, err := c.imageStatus(ctx, imageName)
+	if err != nil {
+		return "", err
+	}
+	if img == nil {
+		return "", fmt.Errorf("%w in cri-o: %s", errdefs.ErrImageNotFound, imageName)
 	}
-	return true
+	return imageReference(img), nil
+}
+
+// imageReference prefers a tag so archives keep the image name
+func imageReference(img *runtimeapi.Image) string {
+	if len(img.RepoTags) > 0 {
+		return img.RepoTags[0]
+	}
+	return img.Id
 }
 
 func (c CRIO) ExtractImage(imageID, imageName, path string) error {
-	cmd := exec.Command("podman", "save", "--events-backend", "file",
-		"--format", "docker-dir", "--output", path, imageName)
+	return c.ExtractImageContext(context.Background(), imageID, imageName, path)
+}
+
+// ExtractImageContext saves the image from the CRI-O store as a docker-dir into path
+func (c CRIO) ExtractImageContext(ctx context.Context, imageID, imageName, path string) (err error) {
+	defer errdefs.Annotate(ctx, &err, utils.CRIO, "extract image", imageName, errdefs.ErrImageNotFound)
+	ref, err := c.resolveImage(ctx, imageName)
+	if err != nil {
+		return err
+	}
+	cmd, err := c.podmanCommand(ctx, "extract image", "save", "--events-backend", "file",
+		"--format", "docker-dir", "--output", path, ref)
+	if err != nil {
+		return err
+	}
 	logrus.Infof("extract image command: %s", cmd.String())
 	if _, err := cmd.Output(); err != nil {
 		return err
@@ -40,61 +108,314 @@ func (c CRIO) ExtractImage(imageID, imageName, path string) error {
 }
 
 func (c CRIO) GetImageID(imageName string) ([]byte, error) {
-	cmd := exec.Command("podman", "inspect", imageName,
-		"--type", "image", "--format", "{{ .ID }}")
-	logrus.Infof("get imageID command: %s", cmd.String())
-	return cmd.Output()
+	return c.GetImageIDContext(context.Background(), imageName)
+}
+
+// GetImageIDContext returns the image id using the CRI image service
+func (c CRIO) GetImageIDContext(ctx context.Context, imageName string) (_ []byte, err error) {
+	defer errdefs.Annotate(ctx, &err, utils.CRIO, "image id", imageName, errdefs.ErrImageNotFound)
+	img, err := c.imageStatus(ctx, imageName)
+	if err != nil {
+		return nil, err
+	}
+	if img == nil {
+		return nil, fmt.Errorf("%w in cri-o: %s", errdefs.ErrImageNotFound, imageName)
+	}
+	return []byte(img.Id + "\n"), nil
 }
 
 func (c CRIO) Save(imageName, outputParam string) ([]byte, error) {
-	cmd := exec.Command("podman", "save", "--events-backend", "file",
-		"--format", "docker-archive", "--output", outputParam, imageName)
+	return c.SaveContext(context.Background(), imageName, outputParam)
+}
+
+// SaveContext saves the image from the CRI-O store as a docker-archive
+func (c CRIO) SaveContext(ctx context.Context, imageName, outputParam string) (_ []byte, err error) {
+	defer errdefs.Annotate(ctx, &err, utils.CRIO, "save", imageName, errdefs.ErrImageNotFound)
+	ref, err := c.resolveImage(ctx, imageName)
+	if err != nil {
+		return nil, err
+	}
+	cmd, err := c.podmanCommand(ctx, "save", "save", "--events-backend", "file",
+		"--format", "docker-archive", "--output", outputParam, ref)
+	if err != nil {
+		return nil, err
+	}
 	logrus.Infof("save image command: %s", cmd.String())
 	return cmd.Output()
 }
 
+// SaveTo streams the image from the CRI-O store as a docker-archive to w
+func (c CRIO) SaveTo(ctx context.Context, imageName string, w io.Writer) (err error) {
+	defer errdefs.Annotate(ctx, &err, utils.CRIO, "save", imageName, errdefs.ErrImageNotFound)
+	ref, err := c.resolveImage(ctx, imageName)
+	if err != nil {
+		return err
+	}
+	cmd, err := c.podmanCommand(ctx, "save", "save", "--events-backend", "file", "--format", "docker-archive", ref)
+	if err != nil {
+		return err
+	}
+	logrus.Infof("save image command: %s", cmd.String())
+	return utils.RunCommandTo(cmd, w, "podman save: "+ref+": ")
+}
+
 func (c CRIO) ExtractFileSystem(imageTarPath string, outputTarPath string, imageName string) error {
-	return errors.New("function not implemented for cri-o")
+	return c.ExtractFileSystemContext(context.Background(), imageTarPath, outputTarPath, imageName)
+}
+
+// ExtractFileSystemContext flattens the layers of the saved image into a root filesystem tar,
+// CRI-O can not create dormant containers so the image tar is merged without the runtime
+func (c CRIO) ExtractFileSystemContext(ctx context.Context, imageTarPath string, outputTarPath string, imageName string) (err error) {
+	defer errdefs.Annotate(ctx, &err, utils.CRIO, "extract file system", imageName, nil)
+	err = utils.FlattenImageTar(ctx, imageTarPath, outputTarPath)
+	if err != nil {
+		logrus.Errorf("error while flattening image tar %s of %s: %s", imageTarPath, imageName, err)
+		return err
+	}
+	return nil
 }
 
 func (c CRIO) ExtractFileSystemContainer(containerId string, namespace string, outputTarPath string) error {
+	return c.ExtractFileSystemContainerContext(context.Background(), containerId, namespace, outputTarPath)
+}
 
-	// inspect does not accept runtime endpoint option
-	_, _ = exec.Command(
-		"crictl",
-		"config",
-		"--set", "runtime-endpoint="+c.socketPath).Output()
-	// get root path
-	cmd := exec.Command(
-		"crictl",
-		"inspect",
-		"--output", "go-template",
-		"--template", "\"{{ .info.runtimeSpec.root.path }}\"", containerId)
-	logrus.Infof("contaier root path command: %s", cmd.String())
-	rootpath, err := cmd.Output()
+// ExtractFileSystemContainerContext packs the container root path reported by the CRI container status
+func (c CRIO) ExtractFileSystemContainerContext(ctx context.Context, containerId string, namespace string, outputTarPath string) (err error) {
+	defer errdefs.Annotate(ctx, &err, utils.CRIO, "export container", containerId, errdefs.ErrContainerNotFound)
+	return utils.WriteFileFunc(outputTarPath, func(w io.Writer) error {
+		return c.ExportContainerTo(ctx, containerId, namespace, w)
+	})
+}
+
+// ExportContainerTo streams the root filesystem CRI-O mounted for the container as a tar to w
+func (c CRIO) ExportContainerTo(ctx context.Context, containerId string, namespace string, w io.Writer) (err error) {
+	defer errdefs.Annotate(ctx, &err, utils.CRIO, "export container", containerId, errdefs.ErrContainerNotFound)
+	_, info, err := c.containerStatus(ctx, containerId)
 	if err != nil {
 		logrus.Errorf("failed to get container root path error %s", err)
 		return err
 	}
-
-	cleanrootpath := strings.Trim(strings.TrimSpace(string(rootpath)), "\"")
-	logrus.Infof("containerId: %s rootPath: %s", containerId, cleanrootpath)
-
-	if len(rootpath) < 1 {
+	if info.RuntimeSpec == nil || info.RuntimeSpec.Root == nil || info.RuntimeSpec.Root.Path == "" {
 		logrus.Errorf("container root path is empty for containerID %s", containerId)
 		return errors.New("container root path is empty")
 	}
+	rootpath := utils.HostPath(info.RuntimeSpec.Root.Path)
+	logrus.Infof("containerId: %s rootPath: %s", containerId, rootpath)
+	if err := utils.TarDirectory(ctx, rootpath, w); err != nil {
+		logrus.Errorf("error while packing tar containerId: %s path: %s error: %s", containerId, rootpath, err)
+		return err
+	}
+	return nil
+}
+
+// ListContainers returns the containers CRI-O runs for the kubelet, exited ones included
+func (c CRIO) ListContainers(ctx context.Context) (_ []types.Container, err error) {
+	defer errdefs.Annotate(ctx, &err, utils.CRIO, "list containers", "", nil)
+	conn, err := c.newConnection()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	resp, err := runtimeapi.NewRuntimeServiceClient(conn).ListContainers(ctx, &runtimeapi.ListContainersRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("list containers: %w", err)
+	}
+	containers := make([]types.Container, 0, len(resp.Containers))
+	for _, criContainer := range resp.Containers {
+		container := types.Container{
+			ID:          criContainer.Id,
+			Name:        criContainer.GetMetadata().GetName(),
+			Image:       criContainer.GetImage().GetImage(),
+			ImageDigest: criContainer.ImageRef,
+			State:       containerState(criContainer.State),
+			Labels:      criContainer.Labels,
+			Created:     time.Unix(0, criContainer.CreatedAt),
+		}
+		// CRI-O reports the image id as image, the annotation keeps the name the pod asked for
+		if name := criContainer.Annotations[imageNameAnnotation]; name != "" {
+			container.Image = name
+		}
+		container.SetPodFromLabels()
+		containers = append(containers, container)
+	}
+	return containers, nil
+}
+
+// containerState maps the CRI container states onto the normalized ones
+func containerState(state runtimeapi.ContainerState) string {
+	switch state {
+	case runtimeapi.ContainerState_CONTAINER_CREATED:
+		return types.ContainerStateCreated
+	case runtimeapi.ContainerState_CONTAINER_RUNNING:
+		return types.ContainerStateRunning
+	case runtimeapi.ContainerState_CONTAINER_EXITED:
+		return types.ContainerStateExited
+	}
+	return types.ContainerStateUnknown
+}
 
-	cmd = exec.Command("tar", "-cvf", outputTarPath, "-C", cleanrootpath, ".")
-	logrus.Infof("tar command: %s", cmd.String())
-	_, err = cmd.Output()
-	if !utils.CheckTarFileValid(outputTarPath) {
+// ListImages returns the images of the CRI-O store, creation time and platform come from the verbose image status
+func (c CRIO) ListImages(ctx context.Context) (_ []types.Image, err error) {
+	defer errdefs.Annotate(ctx, &err, utils.CRIO, "list images", "", nil)
+	conn, err := c.newConnection()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	imageService := runtimeapi.NewImageServiceClient(conn)
+	resp, err := imageService.ListImages(ctx, &runtimeapi.ListImagesRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("list images: %w", err)
+	}
+	images := make([]types.Image, 0, len(resp.Images))
+	for _, criImage := range resp.Images {
+		img := imageRecord(criImage)
+		_, info, err := imageStatus(ctx, imageService, criImage.Id, true)
 		if err != nil {
-			logrus.Errorf("error while packing tar containerId: %s file: %s path: %s error: %s",
-				containerId, outputTarPath, rootpath, err)
-			return err
+			logrus.Debug(err.Error())
+		} else if info.ImageSpec != nil {
+			if info.ImageSpec.Created != nil {
+				img.Created = *info.ImageSpec.Created
+			}
+			img.Platform = platforms.Format(info.ImageSpec.Platform)
 		}
+		images = append(images, img)
 	}
+	return images, nil
+}
 
-	return nil
+// imageRecord maps what the CRI reports of an image onto the normalized record
+func imageRecord(criImage *runtimeapi.Image) types.Image {
+	return types.Image{
+		ID:           criImage.Id,
+		RepoTags:     criImage.RepoTags,
+		RepoDigests:  criImage.RepoDigests,
+		ConfigDigest: "sha256:" + strings.TrimPrefix(criImage.Id, "sha256:"),
+		Size:         int64(criImage.Size_),
+	}
+}
+
+// InspectImage returns the config, layers and history of the image from the verbose image status
+func (c CRIO) InspectImage(ctx context.Context, imageName string) (_ *types.ImageInspect, err error) {
+	defer errdefs.Annotate(ctx, &err, utils.CRIO, "inspect image", imageName, errdefs.ErrImageNotFound)
+	conn, err := c.newConnection()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	criImage, info, err := imageStatus(ctx, runtimeapi.NewImageServiceClient(conn), imageName, true)
+	if err != nil {
+		return nil, err
+	}
+	if criImage == nil {
+		return nil, fmt.Errorf("%w in cri-o: %s", errdefs.ErrImageNotFound, imageName)
+	}
+	result := &types.ImageInspect{Image: imageRecord(criImage)}
+	if info.ImageSpec == nil {
+		// the verbose image status of older CRI-O releases lacks the image spec
+		return nil, errdefs.New(errdefs.ErrNotImplemented, utils.CRIO, "verbose image status", imageName)
+	}
+	result.SetFromOCIConfig(*info.ImageSpec)
+	return result, nil
+}
+
+// InspectContainer returns the rootfs, storage, mounts and process details of the container,
+// the runtime spec CRI-O reports in the verbose status is authoritative for rootfs, env and cgroup
+func (c CRIO) InspectContainer(ctx context.Context, containerId string, namespace string) (_ *types.ContainerInspect, err error) {
+	defer errdefs.Annotate(ctx, &err, utils.CRIO, "inspect container", containerId, errdefs.ErrContainerNotFound)
+	status, info, err := c.containerStatus(ctx, containerId)
+	if err != nil {
+		return nil, err
+	}
+	result := &types.ContainerInspect{
+		Container: types.Container{
+			ID:          status.Id,
+			Name:        status.GetMetadata().GetName(),
+			Image:       status.GetImage().GetImage(),
+			ImageDigest: status.ImageRef,
+			State:       containerState(status.State),
+			Labels:      status.Labels,
+			Created:     time.Unix(0, status.CreatedAt),
+		},
+		Pid:       info.Pid,
+		SandboxID: info.SandboxID,
+	}
+	if name := status.Annotations[imageNameAnnotation]; name != "" {
+		result.Image = name
+	}
+	if storage, err := c.daemonInfo(ctx); err == nil {
+		result.Snapshotter = storage.StorageDriver
+	}
+	if spec := info.RuntimeSpec; spec != nil {
+		// the root is only mounted while the container runs
+		if spec.Root != nil && status.State == runtimeapi.ContainerState_CONTAINER_RUNNING {
+			result.RootFS = utils.HostPath(spec.Root.Path)
+		}
+		if spec.Process != nil {
+			result.Env = spec.Process.Env
+		}
+		if spec.Linux != nil {
+			result.CgroupPath = spec.Linux.CgroupsPath
+		}
+		for _, mount := range spec.Mounts {
+			result.Mounts = append(result.Mounts, types.Mount{
+				Type:        mount.Type,
+				Source:      mount.Source,
+				Destination: mount.Destination,
+				Options:     mount.Options,
+				ReadOnly:    slices.Contains(mount.Options, "ro"),
+			})
+		}
+	} else {
+		for _, mount := range status.Mounts {
+			result.Mounts = append(result.Mounts, types.Mount{
+				Type:        "bind",
+				Source:      mount.HostPath,
+				Destination: mount.ContainerPath,
+				ReadOnly:    mount.Readonly,
+			})
+		}
+	}
+	if result.Pid > 0 {
+		if cgroupPath := utils.CgroupPath(result.Pid); cgroupPath != "" {
+			result.CgroupPath = cgroupPath
+		}
+	}
+	result.SetPodFromLabels()
+	return result, nil
+}
+
+// Info returns the version, CRI API version, storage, cgroup driver and platform of CRI-O,
+// from the CRI version and the CRI-O /info endpoint
+func (c CRIO) Info(ctx context.Context) (_ *types.RuntimeInfo, err error) {
+	defer errdefs.Annotate(ctx, &err, utils.CRIO, "info", "", nil)
+	conn, err := c.newConnection()
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	version, err := runtimeapi.NewRuntimeServiceClient(conn).Version(ctx, &runtimeapi.VersionRequest{})
+	if err != nil {
+		return nil, fmt.Errorf("cri version: %w", err)
+	}
+	// CRI-O does not report its platform, it runs on the host vessel talks to over the socket
+	platform := platforms.DefaultSpec()
+	info := &types.RuntimeInfo{
+		Runtime:       utils.CRIO,
+		Endpoint:      c.socketPath,
+		Version:       version.RuntimeVersion,
+		APIVersion:    version.RuntimeApiVersion,
+		CgroupVersion: utils.CgroupVersion(),
+		OS:            platform.OS,
+		Architecture:  platform.Architecture,
+	}
+	daemon, err := c.daemonInfo(ctx)
+	if err != nil {
+		logrus.Debugf("crio info not available: %s", err)
+		return info, nil
+	}
+	info.StorageDriver = daemon.StorageDriver
+	info.RootDir = daemon.StorageRoot
+	info.CgroupDriver = daemon.CgroupDriver
+	return info, nil
 }
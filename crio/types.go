@@ -1,5 +1,8 @@
 package crio
 
+// CRIO talks to CRI-O over the CRI gRPC API and its http API on the same socket. Save, SaveTo and
+// ExtractImage read the image content, which the CRI does not serve, with the podman binary pointed at
+// the storage root and runroot of CRI-O: podman must be installed and see the store of the host.
 type CRIO struct {
 	socketPath string
 }
@@ -1,20 +1,38 @@
 package docker
 
 import (
-	"bufio"
-	"bytes"
-	"errors"
-	"os/exec"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
 	"strings"
+	"time"
 
+	"github.com/containerd/platforms"
+	"github.com/deepfence/vessel/errdefs"
+	"github.com/deepfence/vessel/types"
 	"github.com/deepfence/vessel/utils"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/sirupsen/logrus"
 )
 
 // New instantiates a new Docker runtime object
 func New(endpoint string) *Docker {
+	return NewRemote(endpoint, utils.TLSFromEnv())
+}
+
+// NewRemote instantiates a Docker runtime object for a daemon which may not be on a local socket,
+// tlsConfig is used for tcp:// endpoints
+func NewRemote(endpoint string, tlsConfig *utils.TLSConfig) *Docker {
 	return &Docker{
 		socketPath: endpoint,
+		tls:        tlsConfig,
+		store:      &storeRoot{},
 	}
 }
 
@@ -23,109 +41,440 @@ func (d Docker) GetSocket() string {
 	return d.socketPath
 }
 
+// newClient returns an engine API client talking to the detected socket
+func (d Docker) newClient() (*client.Client, error) {
+	return NewClient(d.socketPath, d.tls)
+}
+
+// NewClient returns an engine API client for the daemon at endpoint,
+// over tls when tlsConfig is set and the endpoint is a tcp:// one
+func NewClient(endpoint string, tlsConfig *utils.TLSConfig) (*client.Client, error) {
+	opts := []client.Opt{client.WithAPIVersionNegotiation()}
+	if tlsConfig != nil && utils.IsTCPEndpoint(endpoint) {
+		config, err := tlsConfig.ClientConfig()
+		if err != nil {
+			return nil, fmt.Errorf("error loading docker tls config: %w", err)
+		}
+		opts = append(opts, client.WithHTTPClient(&http.Client{
+			Transport:     &http.Transport{TLSClientConfig: config},
+			CheckRedirect: client.CheckRedirect,
+		}))
+	}
+	opts = append(opts, client.WithHost(endpoint))
+	dockerCli, err := client.NewClientWithOpts(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("error creating docker client: %w", err)
+	}
+	return dockerCli, nil
+}
+
 // ImageExists checks if the image exists
 func (d Docker) ImageExists(imageName string) bool {
-	_, err := exec.Command("docker", "inspect", imageName).Output()
+	return d.ImageExistsContext(context.Background(), imageName)
+}
+
+// ImageExistsContext checks if the image exists, a daemon failing to answer is logged and reported as missing
+func (d Docker) ImageExistsContext(ctx context.Context, imageName string) bool {
+	location, err := d.LookupImage(ctx, imageName)
+	if err != nil {
+		logrus.Debug(err.Error())
+	}
+	return location != nil
+}
+
+// LookupImage finds the image by name, id or digest, the store is the data root of the daemon,
+// read from the daemon info on the first lookup only
+func (d Docker) LookupImage(ctx context.Context, imageName string) (_ *types.ImageLocation, err error) {
+	defer errdefs.Annotate(ctx, &err, utils.DOCKER, "lookup image", imageName, errdefs.ErrImageNotFound)
+	dockerCli, err := d.newClient()
 	if err != nil {
-		return false
+		return nil, err
+	}
+	defer dockerCli.Close()
+	id := ""
+	inspect, err := dockerCli.ImageInspect(ctx, imageName)
+	switch {
+	case err == nil:
+		id = inspect.ID
+	case !errdefs.IsNotFound(err):
+		return nil, fmt.Errorf("docker inspect %s: %w", imageName, err)
+	default:
+		// the daemon resolves repo@digest but not a bare manifest digest
+		if _, parseErr := digest.Parse(imageName); parseErr != nil {
+			return nil, nil
+		}
+		summaries, err := dockerCli.ImageList(ctx, image.ListOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("docker images: %w", err)
+		}
+		for _, summary := range summaries {
+			for _, repoDigest := range summary.RepoDigests {
+				if strings.HasSuffix(repoDigest, "@"+imageName) {
+					id = summary.ID
+				}
+			}
+		}
+		if id == "" {
+			return nil, nil
+		}
+	}
+	location := &types.ImageLocation{ID: id, Store: d.store.get()}
+	if location.Store == "" {
+		if info, err := dockerCli.Info(ctx); err == nil {
+			location.Store = info.DockerRootDir
+			d.store.set(location.Store)
+		}
 	}
-	return true
+	return location, nil
 }
 
 // ExtractImage creates the tarball out of image and extracts it
 func (d Docker) ExtractImage(imageID, imageName, path string) error {
-	var stderr bytes.Buffer
-	save := exec.Command("docker", "save", imageID)
-	save.Stderr = &stderr
-	extract := exec.Command("tar", "xf", "-", "--warning=none", "-C"+path)
-	extract.Stderr = &stderr
-	pipe, err := extract.StdinPipe()
+	return d.ExtractImageContext(context.Background(), imageID, imageName, path)
+}
+
+// ExtractImageContext streams the image tarball straight into path
+func (d Docker) ExtractImageContext(ctx context.Context, imageID, imageName, path string) (err error) {
+	defer errdefs.Annotate(ctx, &err, utils.DOCKER, "extract image", imageName, errdefs.ErrImageNotFound)
+	dockerCli, err := d.newClient()
 	if err != nil {
 		return err
 	}
-	save.Stdout = pipe
+	defer dockerCli.Close()
+	reader, err := dockerCli.ImageSave(ctx, []string{imageID})
+	if err != nil {
+		return fmt.Errorf("docker save %s: %w", imageID, err)
+	}
+	defer reader.Close()
+	return utils.ExtractTar(reader, path)
+}
 
-	err = extract.Start()
+// GetImageID returns the image id
+func (d Docker) GetImageID(imageName string) ([]byte, error) {
+	return d.GetImageIDContext(context.Background(), imageName)
+}
+
+// GetImageIDContext returns the ids of the images matching the reference, one per line
+func (d Docker) GetImageIDContext(ctx context.Context, imageName string) (_ []byte, err error) {
+	defer errdefs.Annotate(ctx, &err, utils.DOCKER, "image id", imageName, errdefs.ErrImageNotFound)
+	dockerCli, err := d.newClient()
 	if err != nil {
-		return errors.New(stderr.String())
+		return nil, err
 	}
-	err = save.Run()
+	defer dockerCli.Close()
+	summaries, err := dockerCli.ImageList(ctx, image.ListOptions{
+		Filters: filters.NewArgs(filters.Arg("reference", imageName)),
+	})
 	if err != nil {
-		return errors.New(stderr.String())
+		return nil, fmt.Errorf("docker images %s: %w", imageName, err)
+	}
+	var ids strings.Builder
+	for _, summary := range summaries {
+		ids.WriteString(summary.ID + "\n")
 	}
-	err = pipe.Close()
+	return []byte(ids.String()), nil
+}
+
+// Save just saves image using -o flag
+func (d Docker) Save(imageName, outputParam string) ([]byte, error) {
+	return d.SaveContext(context.Background(), imageName, outputParam)
+}
+
+// SaveContext writes the image tarball to outputParam
+func (d Docker) SaveContext(ctx context.Context, imageName, outputParam string) (_ []byte, err error) {
+	defer errdefs.Annotate(ctx, &err, utils.DOCKER, "save", imageName, errdefs.ErrImageNotFound)
+	return nil, utils.WriteFileFunc(outputParam, func(w io.Writer) error {
+		return d.SaveTo(ctx, imageName, w)
+	})
+}
+
+// SaveTo streams the image tarball to w
+func (d Docker) SaveTo(ctx context.Context, imageName string, w io.Writer) (err error) {
+	defer errdefs.Annotate(ctx, &err, utils.DOCKER, "save", imageName, errdefs.ErrImageNotFound)
+	dockerCli, err := d.newClient()
 	if err != nil {
 		return err
 	}
-	err = extract.Wait()
+	defer dockerCli.Close()
+	reader, err := dockerCli.ImageSave(ctx, []string{imageName})
 	if err != nil {
-		return errors.New(stderr.String())
+		return fmt.Errorf("docker save %s: %w", imageName, err)
+	}
+	defer reader.Close()
+	_, err = io.Copy(w, reader)
+	return err
+}
+
+// ExtractFileSystem Extract the file system from tar of an image by merging its layers
+func (d Docker) ExtractFileSystem(imageTarPath string, outputTarPath string, imageName string) error {
+	return d.ExtractFileSystemContext(context.Background(), imageTarPath, outputTarPath, imageName)
+}
+
+// ExtractFileSystemContext Extract the file system from tar of an image by merging its layers,
+// the daemon is not involved so nothing is loaded or created on it
+func (d Docker) ExtractFileSystemContext(ctx context.Context, imageTarPath string, outputTarPath string, imageName string) (err error) {
+	defer errdefs.Annotate(ctx, &err, utils.DOCKER, "extract file system", imageName, nil)
+	err = utils.FlattenImageTar(ctx, imageTarPath, outputTarPath)
+	if err != nil {
+		return fmt.Errorf("extract file system of %s from %s: %w", imageName, imageTarPath, err)
 	}
 	return nil
 }
 
-// GetImageID returns the image id
-func (d Docker) GetImageID(imageName string) ([]byte, error) {
-	return exec.Command("docker", "images", "-q", "--no-trunc", imageName).Output()
+// ExtractFileSystemContainer Extract the file system of an existing container to tar
+func (d Docker) ExtractFileSystemContainer(containerId string, namespace string, outputTarPath string) error {
+	return d.ExtractFileSystemContainerContext(context.Background(), containerId, namespace, outputTarPath)
 }
 
-// Save just saves image using -o flag
-func (d Docker) Save(imageName, outputParam string) ([]byte, error) {
-	return exec.Command("docker", "save", imageName, "-o", outputParam).Output()
+// ExtractFileSystemContainerContext Extract the file system of an existing container to tar
+func (d Docker) ExtractFileSystemContainerContext(ctx context.Context, containerId string, namespace string, outputTarPath string) (err error) {
+	defer errdefs.Annotate(ctx, &err, utils.DOCKER, "export container", containerId, errdefs.ErrContainerNotFound)
+	return utils.WriteFileFunc(outputTarPath, func(w io.Writer) error {
+		return d.ExportContainerTo(ctx, strings.TrimSpace(containerId), namespace, w)
+	})
 }
 
-// ExtractFileSystem Extract the file system from tar of an image by creating a temporary dormant container instance
-func (d Docker) ExtractFileSystem(imageTarPath string, outputTarPath string, imageName string) error {
-	imageMsg, err := utils.RunCommand(exec.Command("docker", "load", "-i", imageTarPath), "docker load: "+imageTarPath)
+// ExportContainerTo streams the file system of the container as a tar to w
+func (d Docker) ExportContainerTo(ctx context.Context, containerId string, namespace string, w io.Writer) (err error) {
+	defer errdefs.Annotate(ctx, &err, utils.DOCKER, "export container", containerId, errdefs.ErrContainerNotFound)
+	dockerCli, err := d.newClient()
 	if err != nil {
 		return err
 	}
-	var imageId = ""
-	scanner := bufio.NewScanner(imageMsg)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.Contains(line, "Loaded image") {
-			splits := strings.SplitAfterN(line, ":", 2)
-			if len(splits) > 1 {
-				imageId = strings.TrimSpace(splits[1])
-				break
-			}
+	defer dockerCli.Close()
+	reader, err := dockerCli.ContainerExport(ctx, containerId)
+	if err != nil {
+		return fmt.Errorf("docker export %s: %w", containerId, err)
+	}
+	defer reader.Close()
+	_, err = io.Copy(w, reader)
+	return err
+}
+
+// GetFileSystemPathsForContainer returns the container name and its merged dir separated by a tab
+func (d Docker) GetFileSystemPathsForContainer(containerId string, namespace string) ([]byte, error) {
+	info, err := d.InspectContainer(context.Background(), strings.TrimSpace(containerId), namespace)
+	if err != nil {
+		return nil, err
+	}
+	return []byte("/" + info.Name + "\t" + info.RootFS + "\n"), nil
+}
+
+// ListContainers returns all the containers of the daemon, stopped ones included
+func (d Docker) ListContainers(ctx context.Context) (_ []types.Container, err error) {
+	defer errdefs.Annotate(ctx, &err, utils.DOCKER, "list containers", "", nil)
+	dockerCli, err := d.newClient()
+	if err != nil {
+		return nil, err
+	}
+	defer dockerCli.Close()
+	summaries, err := dockerCli.ContainerList(ctx, container.ListOptions{All: true})
+	if err != nil {
+		return nil, fmt.Errorf("docker ps: %w", err)
+	}
+	containers := make([]types.Container, 0, len(summaries))
+	for _, summary := range summaries {
+		c := types.Container{
+			ID:          summary.ID,
+			Image:       summary.Image,
+			ImageDigest: summary.ImageID,
+			State:       containerState(summary.State),
+			Labels:      summary.Labels,
+			Created:     time.Unix(summary.Created, 0),
 		}
+		if len(summary.Names) > 0 {
+			c.Name = strings.TrimPrefix(summary.Names[0], "/")
+		}
+		c.SetPodFromLabels()
+		containers = append(containers, c)
 	}
-	if imageId == "" {
-		return errors.New("image not found from docker load with output: " + imageMsg.String())
+	return containers, nil
+}
+
+// containerState maps the docker container states onto the normalized ones
+func containerState(state string) string {
+	switch state {
+	case "created":
+		return types.ContainerStateCreated
+	case "running", "restarting":
+		return types.ContainerStateRunning
+	case "paused":
+		return types.ContainerStatePaused
+	case "exited", "dead", "removing":
+		return types.ContainerStateExited
 	}
-	containerOutput, err := utils.RunCommand(exec.Command("docker", "create", imageId), "docker create: "+imageId)
+	return types.ContainerStateUnknown
+}
+
+// ListImages returns the tagged and untagged images of the daemon from the image list alone,
+// which has no platform: InspectImage reports it
+func (d Docker) ListImages(ctx context.Context) (_ []types.Image, err error) {
+	defer errdefs.Annotate(ctx, &err, utils.DOCKER, "list images", "", nil)
+	dockerCli, err := d.newClient()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	containerId := strings.TrimSpace(containerOutput.String())
-	_, err = utils.RunCommand(exec.Command("docker", "export", strings.TrimSpace(containerId), "-o", outputTarPath), "docker export: "+string(containerId))
+	defer dockerCli.Close()
+	summaries, err := dockerCli.ImageList(ctx, image.ListOptions{})
 	if err != nil {
-		return err
+		return nil, fmt.Errorf("docker images: %w", err)
 	}
-	_, err = utils.RunCommand(exec.Command("docker", "container", "rm", containerId), "delete container:"+containerId)
+	images := make([]types.Image, 0, len(summaries))
+	for _, summary := range summaries {
+		images = append(images, types.Image{
+			ID:           summary.ID,
+			RepoTags:     summary.RepoTags,
+			RepoDigests:  summary.RepoDigests,
+			ConfigDigest: summary.ID,
+			Size:         summary.Size,
+			Created:      time.Unix(summary.Created, 0),
+		})
+	}
+	return images, nil
+}
+
+// InspectImage returns the config, layers and history of the image
+func (d Docker) InspectImage(ctx context.Context, imageName string) (_ *types.ImageInspect, err error) {
+	defer errdefs.Annotate(ctx, &err, utils.DOCKER, "inspect image", imageName, errdefs.ErrImageNotFound)
+	dockerCli, err := d.newClient()
 	if err != nil {
-		logrus.Warn(err.Error())
+		return nil, err
 	}
-	_, err = utils.RunCommand(exec.Command("docker", "image", "rm", imageId), "delete image:"+imageId)
+	defer dockerCli.Close()
+	inspect, err := dockerCli.ImageInspect(ctx, imageName)
 	if err != nil {
-		logrus.Warn(err.Error())
+		return nil, fmt.Errorf("docker inspect %s: %w", imageName, err)
 	}
-	return nil
+	result := &types.ImageInspect{
+		Image: types.Image{
+			ID:           inspect.ID,
+			RepoTags:     inspect.RepoTags,
+			RepoDigests:  inspect.RepoDigests,
+			ConfigDigest: inspect.ID,
+			Size:         inspect.Size,
+			Platform:     platforms.Format(ocispec.Platform{OS: inspect.Os, Architecture: inspect.Architecture, Variant: inspect.Variant}),
+		},
+		DiffIDs: inspect.RootFS.Layers,
+	}
+	if created, err := time.Parse(time.RFC3339Nano, inspect.Created); err == nil {
+		result.Created = created
+	}
+	if inspect.Config != nil {
+		result.Config = ocispec.ImageConfig{
+			User:       inspect.Config.User,
+			Env:        inspect.Config.Env,
+			Entrypoint: inspect.Config.Entrypoint,
+			Cmd:        inspect.Config.Cmd,
+			Volumes:    inspect.Config.Volumes,
+			WorkingDir: inspect.Config.WorkingDir,
+			Labels:     inspect.Config.Labels,
+			StopSignal: inspect.Config.StopSignal,
+		}
+		if len(inspect.Config.ExposedPorts) > 0 {
+			result.Config.ExposedPorts = map[string]struct{}{}
+			for port := range inspect.Config.ExposedPorts {
+				result.Config.ExposedPorts[string(port)] = struct{}{}
+			}
+		}
+	}
+	history, err := dockerCli.ImageHistory(ctx, inspect.ID)
+	if err != nil {
+		return nil, fmt.Errorf("docker history %s: %w", imageName, err)
+	}
+	// docker lists the newest step first, OCI the oldest
+	for i := len(history) - 1; i >= 0; i-- {
+		created := time.Unix(history[i].Created, 0)
+		result.History = append(result.History, ocispec.History{
+			Created:    &created,
+			CreatedBy:  history[i].CreatedBy,
+			Comment:    history[i].Comment,
+			EmptyLayer: history[i].Size == 0,
+		})
+	}
+	return result, nil
 }
 
-// ExtractFileSystemContainer Extract the file system of an existing container to tar
-func (d Docker) ExtractFileSystemContainer(containerId string, namespace string, outputTarPath string) error {
-	cmd := exec.Command("docker", "export", strings.TrimSpace(containerId), "-o", outputTarPath)
-	_, err := utils.RunCommand(cmd, "docker export: "+string(containerId))
+// InspectContainer returns the rootfs, graph driver, mounts and process details of the container
+func (d Docker) InspectContainer(ctx context.Context, containerId string, namespace string) (_ *types.ContainerInspect, err error) {
+	defer errdefs.Annotate(ctx, &err, utils.DOCKER, "inspect container", containerId, errdefs.ErrContainerNotFound)
+	dockerCli, err := d.newClient()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	defer dockerCli.Close()
+	info, err := dockerCli.ContainerInspect(ctx, containerId)
+	if err != nil {
+		return nil, fmt.Errorf("docker inspect %s: %w", containerId, err)
+	}
+	result := &types.ContainerInspect{
+		Container: types.Container{
+			ID:          info.ID,
+			Name:        strings.TrimPrefix(info.Name, "/"),
+			ImageDigest: info.Image,
+			State:       types.ContainerStateUnknown,
+		},
+		Snapshotter: info.GraphDriver.Name,
+		StorageData: info.GraphDriver.Data,
+	}
+	if created, err := time.Parse(time.RFC3339Nano, info.Created); err == nil {
+		result.Created = created
+	}
+	if info.State != nil {
+		result.State = containerState(info.State.Status)
+		result.Pid = info.State.Pid
+		// the graph driver only keeps MergedDir mounted while the container runs
+		if info.State.Running {
+			result.RootFS = utils.HostPath(info.GraphDriver.Data["MergedDir"])
+		}
+	}
+	if info.Config != nil {
+		result.Image = info.Config.Image
+		result.Labels = info.Config.Labels
+		result.Env = info.Config.Env
+	}
+	for _, mount := range info.Mounts {
+		result.Mounts = append(result.Mounts, types.Mount{
+			Type:        string(mount.Type),
+			Source:      mount.Source,
+			Destination: mount.Destination,
+			Options:     strings.FieldsFunc(mount.Mode, func(r rune) bool { return r == ',' }),
+			ReadOnly:    !mount.RW,
+		})
+	}
+	if result.Pid > 0 {
+		result.CgroupPath = utils.CgroupPath(result.Pid)
+	}
+	result.SandboxID = result.Labels["io.kubernetes.sandbox.id"]
+	result.SetPodFromLabels()
+	return result, nil
 }
 
-// ExtractFileSystemContainer Extract the file system of an existing container to tar
-func (d Docker) GetFileSystemPathsForContainer(containerId string, namespace string) ([]byte, error) {
-	return exec.Command("docker", "inspect", strings.TrimSpace(containerId), "|", "jq", "-r", "'map([.Name, .GraphDriver.Data.MergedDir]) | .[] | \"\\(.[0])\t\\(.[1])\"'").Output()
+// Info returns the version, API version, storage, cgroup and platform of the daemon
+func (d Docker) Info(ctx context.Context) (_ *types.RuntimeInfo, err error) {
+	defer errdefs.Annotate(ctx, &err, utils.DOCKER, "info", "", nil)
+	dockerCli, err := d.newClient()
+	if err != nil {
+		return nil, err
+	}
+	defer dockerCli.Close()
+	version, err := dockerCli.ServerVersion(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("docker version: %w", err)
+	}
+	info, err := dockerCli.Info(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("docker info: %w", err)
+	}
+	return &types.RuntimeInfo{
+		Runtime:       utils.DOCKER,
+		Endpoint:      d.socketPath,
+		Version:       version.Version,
+		APIVersion:    version.APIVersion,
+		StorageDriver: info.Driver,
+		CgroupDriver:  info.CgroupDriver,
+		CgroupVersion: info.CgroupVersion,
+		RootDir:       info.DockerRootDir,
+		OS:            version.Os,
+		Architecture:  version.Arch,
+	}, nil
 }
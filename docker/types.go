@@ -1,5 +1,38 @@
 package docker
 
+import (
+	"sync"
+
+	"github.com/deepfence/vessel/utils"
+)
+
 type Docker struct {
 	socketPath string
+	tls        *utils.TLSConfig
+	store      *storeRoot
+}
+
+// storeRoot caches the data root of the daemon LookupImage reports, it is shared by the copies of a Docker.
+// A Docker not made by New has none, the data root is then read on every lookup.
+type storeRoot struct {
+	mu   sync.Mutex
+	root string
+}
+
+func (s *storeRoot) get() string {
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.root
+}
+
+func (s *storeRoot) set(root string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.root = root
 }
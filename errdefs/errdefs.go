@@ -0,0 +1,236 @@
+// Package errdefs defines the errors the runtimes return, whatever the backend,
+// test them with errors.Is against the sentinels or errors.As against *Error
+package errdefs
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	containerdErrdefs "github.com/containerd/errdefs"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var (
+	// ErrImageNotFound is returned when the runtime does not have the image
+	ErrImageNotFound = errors.New("image not found")
+	// ErrContainerNotFound is returned when the runtime does not have the container
+	ErrContainerNotFound = errors.New("container not found")
+	// ErrRuntimeUnreachable is returned when the daemon or the socket does not answer
+	ErrRuntimeUnreachable = errors.New("runtime unreachable")
+	// ErrPermissionDenied is returned when the socket, the store or a mount is refused to vessel
+	ErrPermissionDenied = errors.New("permission denied")
+	// ErrNotImplemented is returned for the operations a runtime does not support
+	ErrNotImplemented = errors.New("not implemented")
+	// ErrToolMissing is returned when a command line tool the backend relies on is not installed
+	ErrToolMissing = errors.New("tool missing")
+	// ErrTimeout is returned when the operation did not complete in time
+	ErrTimeout = errors.New("timeout")
+)
+
+// Error is a failure of a runtime operation classified by Kind, one of the sentinels
+type Error struct {
+	Kind    error
+	Runtime string
+	// Op is the operation which failed, like save or inspect
+	Op string
+	// Subject is the image, container or tool the operation failed on
+	Subject string
+	// Err is the error reported by the runtime, nil when vessel detected the failure itself
+	Err error
+}
+
+func (e *Error) Error() string {
+	if e.Err != nil {
+		if e.Runtime == "" {
+			return e.Kind.Error() + ": " + e.Err.Error()
+		}
+		return e.Runtime + ": " + e.Kind.Error() + ": " + e.Err.Error()
+	}
+	msg := strings.TrimSpace(e.Runtime + " " + e.Op)
+	if e.Subject != "" {
+		msg += " " + e.Subject
+	}
+	return msg + ": " + e.Kind.Error()
+}
+
+// Unwrap lets errors.Is match both the kind and the error reported by the runtime
+func (e *Error) Unwrap() []error {
+	if e.Err == nil {
+		return []error{e.Kind}
+	}
+	return []error{e.Kind, e.Err}
+}
+
+// New returns an error of kind detected by vessel itself
+func New(kind error, runtime, op, subject string) error {
+	return &Error{Kind: kind, Runtime: runtime, Op: op, Subject: subject}
+}
+
+// Wrap classifies err onto the sentinels, notFound is the kind reported when the runtime says
+// the subject does not exist, nil when the subject is neither an image nor a container.
+// Errors which can not be classified are returned unchanged, classified ones missing the runtime
+// or the operation are returned as a copy filling them in, err itself may be shared and is left alone.
+func Wrap(runtime, op, subject string, notFound error, err error) error {
+	if err == nil {
+		return nil
+	}
+	var classified *Error
+	if errors.As(err, &classified) {
+		if classified.Runtime != "" && classified.Op != "" {
+			return err
+		}
+		c := *classified
+		if c.Runtime == "" {
+			c.Runtime = runtime
+		}
+		if c.Op == "" {
+			c.Op = op
+		}
+		// an error wrapping the classified one keeps its message in the copy
+		if err != error(classified) {
+			c.Err = err
+		}
+		return &c
+	}
+	kind := Classify(err, notFound)
+	if kind == nil {
+		return err
+	}
+	return &Error{Kind: kind, Runtime: runtime, Op: op, Subject: subject, Err: err}
+}
+
+// Annotate wraps *errp in place, meant to be deferred by the operations with a named error result.
+// An error left by an expired ctx is a timeout whatever the runtime reported.
+func Annotate(ctx context.Context, errp *error, runtime, op, subject string, notFound error) {
+	if *errp == nil {
+		return
+	}
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) && !errors.Is(*errp, ErrTimeout) {
+		*errp = &Error{Kind: ErrTimeout, Runtime: runtime, Op: op, Subject: subject, Err: *errp}
+		return
+	}
+	*errp = Wrap(runtime, op, subject, notFound, *errp)
+}
+
+// CommandError returns the ErrToolMissing error of cmd when its executable was not found, nil otherwise,
+// check it before running cmd
+func CommandError(cmd *exec.Cmd) error {
+	if cmd.Err == nil || !errors.Is(cmd.Err, exec.ErrNotFound) {
+		return nil
+	}
+	return &Error{Kind: ErrToolMissing, Subject: filepath.Base(cmd.Path), Err: cmd.Err}
+}
+
+// IsNotFound tells whether err says the image or the container does not exist, classified or not
+func IsNotFound(err error) bool {
+	kind := Classify(err, ErrImageNotFound)
+	return kind == ErrImageNotFound || kind == ErrContainerNotFound
+}
+
+// Classify returns the sentinel err falls under, nil if none, from the typed errors of
+// the runtime clients first and from the messages the command line tools print otherwise
+func Classify(err error, notFound error) error {
+	if err == nil {
+		return nil
+	}
+	for _, kind := range []error{ErrImageNotFound, ErrContainerNotFound, ErrRuntimeUnreachable,
+		ErrPermissionDenied, ErrNotImplemented, ErrToolMissing, ErrTimeout} {
+		if errors.Is(err, kind) {
+			return kind
+		}
+	}
+	if kind := classifyTyped(err, notFound); kind != nil {
+		return kind
+	}
+	return classifyMessage(errorMessage(err))
+}
+
+func classifyTyped(err error, notFound error) error {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, os.ErrDeadlineExceeded):
+		return ErrTimeout
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ErrTimeout
+	case errors.Is(err, exec.ErrNotFound):
+		return ErrToolMissing
+	case errors.Is(err, os.ErrPermission):
+		return ErrPermissionDenied
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ErrRuntimeUnreachable
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return ErrRuntimeUnreachable
+	}
+	// containerd translates the gRPC codes itself, docker answers with errors implementing the same interfaces
+	switch {
+	case containerdErrdefs.IsNotFound(err):
+		return notFound
+	case containerdErrdefs.IsUnauthorized(err), containerdErrdefs.IsPermissionDenied(err):
+		return ErrPermissionDenied
+	case containerdErrdefs.IsNotImplemented(err):
+		return ErrNotImplemented
+	case containerdErrdefs.IsUnavailable(err):
+		return ErrRuntimeUnreachable
+	case containerdErrdefs.IsDeadlineExceeded(err):
+		return ErrTimeout
+	}
+	if s, ok := status.FromError(err); ok {
+		switch s.Code() {
+		case codes.NotFound:
+			return notFound
+		case codes.Unavailable:
+			return ErrRuntimeUnreachable
+		case codes.PermissionDenied, codes.Unauthenticated:
+			return ErrPermissionDenied
+		case codes.Unimplemented:
+			return ErrNotImplemented
+		case codes.DeadlineExceeded:
+			return ErrTimeout
+		}
+	}
+	return nil
+}
+
+// errorMessage includes the stderr exec keeps for the commands run with Output
+func errorMessage(err error) string {
+	msg := err.Error()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		msg += ": " + string(exitErr.Stderr)
+	}
+	return strings.ToLower(msg)
+}
+
+// messages maps what docker, podman and the dialers print onto the sentinels, in order of precedence.
+// A bare "not found" or "no such" is not enough: missing blobs, snapshots and files read the same.
+var messages = []struct {
+	kind     error
+	patterns []string
+}{
+	{ErrToolMissing, []string{"executable file not found", "command not found"}},
+	{ErrPermissionDenied, []string{"permission denied", "operation not permitted", "only root can", "must be superuser"}},
+	{ErrRuntimeUnreachable, []string{"cannot connect to", "unable to connect to", "connection refused", "is the docker daemon running"}},
+	{ErrImageNotFound, []string{"no such image", "image not known", "image not found"}},
+	{ErrContainerNotFound, []string{"no such container", "no container with name or id", "container not known", "container not found"}},
+	{ErrTimeout, []string{"deadline exceeded", "i/o timeout"}},
+}
+
+func classifyMessage(msg string) error {
+	for _, m := range messages {
+		for _, pattern := range m.patterns {
+			if strings.Contains(msg, pattern) {
+				return m.kind
+			}
+		}
+	}
+	return nil
+}
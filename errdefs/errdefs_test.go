@@ -0,0 +1,73 @@
+package errdefs
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"testing"
+
+	containerdErrdefs "github.com/containerd/errdefs"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestClassify(t *testing.T) {
+	tests := []struct {
+		name     string
+		err      error
+		notFound error
+		want     error
+	}{
+		{"docker missing image", errors.New("Error response from daemon: No such image: nginx:latest"), ErrImageNotFound, ErrImageNotFound},
+		{"podman missing image", errors.New("Error: nginx: image not known"), ErrImageNotFound, ErrImageNotFound},
+		{"podman missing container", errors.New("Error: no container with name or id \"web\" found"), ErrContainerNotFound, ErrContainerNotFound},
+		{"missing file", errors.New("tar: ./etc: Cannot open: No such file or directory"), ErrImageNotFound, nil},
+		{"missing blob", errors.New("content digest sha256:abc: not found"), ErrImageNotFound, nil},
+		{"missing snapshot parent", errors.New("parent snapshot sha256:abc does not exist: not found"), ErrImageNotFound, nil},
+		{"typed not found", fmt.Errorf("load: %w", containerdErrdefs.ErrNotFound), ErrContainerNotFound, ErrContainerNotFound},
+		{"typed not found without hint", fmt.Errorf("load: %w", containerdErrdefs.ErrNotFound), nil, nil},
+		{"grpc unimplemented", status.Error(codes.Unimplemented, "unknown method"), nil, ErrNotImplemented},
+		{"grpc unavailable", status.Error(codes.Unavailable, "connection error"), nil, ErrRuntimeUnreachable},
+		{"missing executable", fmt.Errorf("podman save: %w", exec.ErrNotFound), nil, ErrToolMissing},
+		{"permission", errors.New("dial unix /run/containerd/containerd.sock: connect: permission denied"), nil, ErrPermissionDenied},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Classify(tt.err, tt.notFound); got != tt.want {
+				t.Fatalf("Classify(%q) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCommandError(t *testing.T) {
+	cmd := exec.Command("vessel-missing-tool")
+	err := Wrap("podman", "save", "nginx", ErrImageNotFound, CommandError(cmd))
+	if !errors.Is(err, ErrToolMissing) {
+		t.Fatalf("missing executable reported as %v", err)
+	}
+	var classified *Error
+	if !errors.As(err, &classified) || classified.Runtime != "podman" || classified.Subject != "vessel-missing-tool" {
+		t.Fatalf("unexpected error %#v", classified)
+	}
+	if err := CommandError(exec.Command("sh")); err != nil {
+		t.Fatalf("existing executable reported as %v", err)
+	}
+}
+
+func TestWrapDoesNotMutate(t *testing.T) {
+	shared := &Error{Kind: ErrToolMissing, Subject: "podman"}
+	for _, err := range []error{shared, fmt.Errorf("save: %w", shared)} {
+		wrapped := Wrap("podman", "save", "nginx", nil, err)
+		var classified *Error
+		if !errors.As(wrapped, &classified) || classified.Runtime != "podman" || classified.Op != "save" {
+			t.Fatalf("wrapped as %#v", classified)
+		}
+		if !errors.Is(wrapped, ErrToolMissing) {
+			t.Fatalf("%v lost its kind", wrapped)
+		}
+	}
+	if shared.Runtime != "" || shared.Op != "" {
+		t.Fatalf("Wrap changed the shared error to %#v", shared)
+	}
+}
@@ -0,0 +1,17 @@
+package vessel
+
+import (
+	"github.com/deepfence/vessel/errdefs"
+)
+
+// The errors every runtime maps its failures onto, test them with errors.Is,
+// errors.As against *errdefs.Error gives the runtime, the operation and the subject
+var (
+	ErrImageNotFound      = errdefs.ErrImageNotFound
+	ErrContainerNotFound  = errdefs.ErrContainerNotFound
+	ErrRuntimeUnreachable = errdefs.ErrRuntimeUnreachable
+	ErrPermissionDenied   = errdefs.ErrPermissionDenied
+	ErrNotImplemented     = errdefs.ErrNotImplemented
+	ErrToolMissing        = errdefs.ErrToolMissing
+	ErrTimeout            = errdefs.ErrTimeout
+)
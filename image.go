@@ -0,0 +1,12 @@
+package vessel
+
+import (
+	"context"
+)
+
+// HasImage tells whether the runtime has the image given as a tag, a digest or an id,
+// unlike ImageExists a runtime failing to answer is an error rather than a missing image
+func HasImage(ctx context.Context, runtime Runtime, imageName string) (bool, error) {
+	location, err := runtime.LookupImage(ctx, imageName)
+	return location != nil, err
+}
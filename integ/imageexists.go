@@ -1,6 +1,8 @@
 package main
 
 import (
+	"context"
+
 	"github.com/deepfence/vessel"
 	"github.com/sirupsen/logrus"
 )
@@ -14,9 +16,13 @@ func main() {
 		return
 	}
 
-	if runtime.ImageExists(imageName) {
-		logrus.Infof("Image %s exists", imageName)
-	} else {
+	location, err := runtime.LookupImage(context.Background(), imageName)
+	switch {
+	case err != nil:
+		logrus.Errorf("Could not look image %s up: %s", imageName, err)
+	case location == nil:
 		logrus.Infof("Image %s does not exist", imageName)
+	default:
+		logrus.Infof("Image %s exists as %s in namespaces %v, store %s", imageName, location.ID, location.Namespaces, location.Store)
 	}
 }
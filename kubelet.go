@@ -0,0 +1,428 @@
+package vessel
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/deepfence/vessel/utils"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	kubeletConfigPath        = "/var/lib/kubelet/config.yaml"
+	serviceAccountDir        = "/var/run/secrets/kubernetes.io/serviceaccount"
+	runtimeEndpointFlag      = "--container-runtime-endpoint"
+	legacyRuntimeFlag        = "--container-runtime"
+	kubeletConfigFlag        = "--config"
+	kubeletKubeconfigFlag    = "--kubeconfig"
+	nodeNameEnv              = "NODE_NAME"
+	kubeconfigEnv            = "KUBECONFIG"
+	kubernetesServiceHost    = "KUBERNETES_SERVICE_HOST"
+	kubernetesServicePort    = "KUBERNETES_SERVICE_PORT"
+	defaultKubeletKubeconfig = "/etc/kubernetes/kubelet.conf"
+)
+
+// kubeletSignal is what the kubelet tells about the runtime it uses,
+// either field may be empty when the source does not know it
+type kubeletSignal struct {
+	Runtime  string
+	Endpoint string
+	Source   string
+}
+
+// kubeletRuntime looks for the runtime of the kubelet, from the strongest source to the weakest:
+// the kubelet flags, the kubelet config file, then the containerRuntimeVersion of the node object
+func kubeletRuntime(ctx context.Context, o *options) *kubeletSignal {
+	flags, process := kubeletFlags()
+	if endpoint := flags[runtimeEndpointFlag]; endpoint != "" {
+		return endpointSignal(endpoint, process+" flag "+runtimeEndpointFlag)
+	}
+	if flags[legacyRuntimeFlag] == utils.DOCKER {
+		// dockershim, before kubernetes 1.24
+		return &kubeletSignal{Runtime: utils.DOCKER, Source: process + " flag " + legacyRuntimeFlag}
+	}
+	configPath := flags[kubeletConfigFlag]
+	if configPath == "" {
+		configPath = kubeletConfigPath
+	}
+	configPath = utils.HostPath(configPath)
+	if endpoint, err := kubeletConfigEndpoint(configPath); err != nil {
+		logrus.Debugf("kubelet config %s: %s", configPath, err)
+	} else if endpoint != "" {
+		return endpointSignal(endpoint, "kubelet config "+configPath)
+	}
+	if process == "k3s" || process == "rke2" {
+		// the embedded kubelet talks to the embedded containerd unless told otherwise
+		return &kubeletSignal{Runtime: utils.CONTAINERD, Endpoint: utils.HostEndpoint(utils.K3S_CONTAINERD_SOCKET_URI), Source: process + " embedded containerd"}
+	}
+	kubeconfig := o.kubeconfig
+	if kubeconfig == "" && flags[kubeletKubeconfigFlag] != "" {
+		kubeconfig = utils.HostPath(flags[kubeletKubeconfigFlag])
+	}
+	version, err := nodeRuntimeVersion(ctx, kubeconfig, o)
+	if err != nil {
+		logrus.Debugf("node containerRuntimeVersion: %s", err)
+		return nil
+	}
+	scheme, _, _ := strings.Cut(version, "://")
+	switch scheme {
+	case "containerd":
+		return &kubeletSignal{Runtime: utils.CONTAINERD, Source: "node containerRuntimeVersion " + version}
+	case "cri-o":
+		return &kubeletSignal{Runtime: utils.CRIO, Source: "node containerRuntimeVersion " + version}
+	case "docker":
+		return &kubeletSignal{Runtime: utils.DOCKER, Source: "node containerRuntimeVersion " + version}
+	}
+	logrus.Debugf("node containerRuntimeVersion %s: unknown runtime", version)
+	return nil
+}
+
+// endpointSignal guesses the runtime from the well known socket names of a CRI endpoint,
+// the docker shims serve CRI only so the docker API is looked for on the usual sockets
+func endpointSignal(endpoint, source string) *kubeletSignal {
+	if !strings.Contains(endpoint, "://") {
+		endpoint = "unix://" + endpoint
+	}
+	endpoint = utils.HostEndpoint(endpoint)
+	switch {
+	case strings.Contains(endpoint, "cri-dockerd") || strings.Contains(endpoint, "dockershim"):
+		return &kubeletSignal{Runtime: utils.DOCKER, Source: source + " " + endpoint}
+	case strings.Contains(endpoint, "containerd"):
+		return &kubeletSignal{Runtime: utils.CONTAINERD, Endpoint: endpoint, Source: source}
+	case strings.Contains(endpoint, "crio"):
+		return &kubeletSignal{Runtime: utils.CRIO, Endpoint: endpoint, Source: source}
+	}
+	return &kubeletSignal{Endpoint: endpoint, Source: source}
+}
+
+// kubeletFlags returns the flags of the kubelet process and the name of the process,
+// k3s and rke2 embed the kubelet in their own process
+func kubeletFlags() (map[string]string, string) {
+	cmdlines, _ := filepath.Glob("/proc/[0-9]*/cmdline")
+	for _, cmdline := range cmdlines {
+		data, err := os.ReadFile(cmdline)
+		if err != nil || len(data) == 0 {
+			continue
+		}
+		args := strings.Split(strings.TrimRight(string(data), "\x00"), "\x00")
+		process := filepath.Base(args[0])
+		switch process {
+		case "kubelet", "k3s", "rke2":
+		default:
+			continue
+		}
+		if process != "kubelet" && (len(args) < 2 || (args[1] != "server" && args[1] != "agent")) {
+			continue
+		}
+		return parseFlags(args[1:]), process
+	}
+	return map[string]string{}, ""
+}
+
+// parseFlags reads --flag=value and --flag value pairs
+func parseFlags(args []string) map[string]string {
+	flags := map[string]string{}
+	for i := 0; i < len(args); i++ {
+		if !strings.HasPrefix(args[i], "--") {
+			continue
+		}
+		if name, value, ok := strings.Cut(args[i], "="); ok {
+			flags[name] = value
+		} else if i+1 < len(args) && !strings.HasPrefix(args[i+1], "--") {
+			flags[args[i]] = args[i+1]
+			i++
+		}
+	}
+	// k3s and rke2 forward kubelet flags as --kubelet-arg=name=value
+	for _, arg := range args {
+		if value, ok := strings.CutPrefix(arg, "--kubelet-arg="); ok {
+			name, value, _ := strings.Cut(strings.TrimPrefix(value, "--"), "=")
+			flags["--"+name] = value
+		}
+	}
+	return flags
+}
+
+// kubeletConfigEndpoint reads containerRuntimeEndpoint from a KubeletConfiguration file
+func kubeletConfigEndpoint(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	var config struct {
+		ContainerRuntimeEndpoint string `yaml:"containerRuntimeEndpoint"`
+	}
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return "", err
+	}
+	return config.ContainerRuntimeEndpoint, nil
+}
+
+// kubeconfig is the part of a kubeconfig file needed to reach the API server
+type kubeconfig struct {
+	CurrentContext string `yaml:"current-context"`
+	Contexts       []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster string `yaml:"cluster"`
+			User    string `yaml:"user"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+	Clusters []struct {
+		Name    string `yaml:"name"`
+		Cluster struct {
+			Server                   string `yaml:"server"`
+			CertificateAuthority     string `yaml:"certificate-authority"`
+			CertificateAuthorityData string `yaml:"certificate-authority-data"`
+			InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+		} `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string `yaml:"name"`
+		User struct {
+			Token                 string `yaml:"token"`
+			TokenFile             string `yaml:"tokenFile"`
+			ClientCertificate     string `yaml:"client-certificate"`
+			ClientCertificateData string `yaml:"client-certificate-data"`
+			ClientKey             string `yaml:"client-key"`
+			ClientKeyData         string `yaml:"client-key-data"`
+			// exec plugins and auth providers are not run, they are only detected to report them
+			Exec         interface{} `yaml:"exec"`
+			AuthProvider interface{} `yaml:"auth-provider"`
+		} `yaml:"user"`
+	} `yaml:"users"`
+}
+
+// apiServer is where and how to query the kubernetes API
+type apiServer struct {
+	server    string
+	token     string
+	tlsConfig *tls.Config
+}
+
+// newAPIServer reads the API server access from the kubeconfig at path,
+// or from the service account of the pod when path is empty.
+// Only tokens and client certificates are supported, not exec plugins nor auth providers.
+func newAPIServer(path string) (*apiServer, error) {
+	if path == "" {
+		path = os.Getenv(kubeconfigEnv)
+	}
+	if path == "" {
+		if _, err := os.Stat(utils.HostPath(defaultKubeletKubeconfig)); err == nil {
+			path = utils.HostPath(defaultKubeletKubeconfig)
+		}
+	}
+	if path == "" {
+		return inClusterAPIServer()
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config kubeconfig
+	if err := yaml.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("kubeconfig %s: %w", path, err)
+	}
+	var clusterName, userName string
+	for _, c := range config.Contexts {
+		if c.Name == config.CurrentContext || (config.CurrentContext == "" && clusterName == "") {
+			clusterName, userName = c.Context.Cluster, c.Context.User
+		}
+	}
+	api := &apiServer{tlsConfig: &tls.Config{}}
+	dir := filepath.Dir(path)
+	for _, c := range config.Clusters {
+		if c.Name != clusterName {
+			continue
+		}
+		api.server = c.Cluster.Server
+		api.tlsConfig.InsecureSkipVerify = c.Cluster.InsecureSkipTLSVerify
+		ca, err := inlineOrFile(c.Cluster.CertificateAuthorityData, c.Cluster.CertificateAuthority, dir)
+		if err != nil {
+			return nil, err
+		}
+		if ca != nil {
+			api.tlsConfig.RootCAs = x509.NewCertPool()
+			api.tlsConfig.RootCAs.AppendCertsFromPEM(ca)
+		}
+	}
+	for _, u := range config.Users {
+		if u.Name != userName {
+			continue
+		}
+		api.token = u.User.Token
+		if u.User.TokenFile != "" {
+			token, err := os.ReadFile(resolvePath(u.User.TokenFile, dir))
+			if err != nil {
+				return nil, err
+			}
+			api.token = strings.TrimSpace(string(token))
+		}
+		cert, err := inlineOrFile(u.User.ClientCertificateData, u.User.ClientCertificate, dir)
+		if err != nil {
+			return nil, err
+		}
+		key, err := inlineOrFile(u.User.ClientKeyData, u.User.ClientKey, dir)
+		if err != nil {
+			return nil, err
+		}
+		if cert != nil && key != nil {
+			pair, err := tls.X509KeyPair(cert, key)
+			if err != nil {
+				return nil, fmt.Errorf("kubeconfig %s: %w", path, err)
+			}
+			api.tlsConfig.Certificates = []tls.Certificate{pair}
+		}
+		if api.token == "" && len(api.tlsConfig.Certificates) == 0 && (u.User.Exec != nil || u.User.AuthProvider != nil) {
+			return nil, fmt.Errorf("kubeconfig %s: user %s authenticates with an exec plugin or an auth provider, only tokens and client certificates are supported", path, userName)
+		}
+	}
+	if api.server == "" {
+		return nil, fmt.Errorf("kubeconfig %s: no server for context %q", path, config.CurrentContext)
+	}
+	return api, nil
+}
+
+// inClusterAPIServer uses the service account mounted in the pod
+func inClusterAPIServer() (*apiServer, error) {
+	host, port := os.Getenv(kubernetesServiceHost), os.Getenv(kubernetesServicePort)
+	if host == "" || port == "" {
+		return nil, errors.New("neither a kubeconfig nor a service account is available")
+	}
+	token, err := os.ReadFile(filepath.Join(serviceAccountDir, "token"))
+	if err != nil {
+		return nil, err
+	}
+	ca, err := os.ReadFile(filepath.Join(serviceAccountDir, "ca.crt"))
+	if err != nil {
+		return nil, err
+	}
+	api := &apiServer{
+		server:    "https://" + net.JoinHostPort(host, port),
+		token:     strings.TrimSpace(string(token)),
+		tlsConfig: &tls.Config{RootCAs: x509.NewCertPool()},
+	}
+	api.tlsConfig.RootCAs.AppendCertsFromPEM(ca)
+	return api, nil
+}
+
+// inlineOrFile returns the base64 data if set, the content of the file otherwise, nil when neither is set
+func inlineOrFile(data, file, dir string) ([]byte, error) {
+	if data != "" {
+		return base64.StdEncoding.DecodeString(data)
+	}
+	if file != "" {
+		return os.ReadFile(resolvePath(file, dir))
+	}
+	return nil, nil
+}
+
+// resolvePath makes the paths of a kubeconfig relative to its directory,
+// the absolute paths of a kubeconfig read from the host are host paths
+func resolvePath(path, dir string) string {
+	if !filepath.IsAbs(path) {
+		return filepath.Join(dir, path)
+	}
+	if root := utils.HostRoot(); root != "/" && strings.HasPrefix(dir, root+"/") {
+		return utils.HostPath(path)
+	}
+	return path
+}
+
+// nodeRuntimeVersion returns status.nodeInfo.containerRuntimeVersion of the node vessel runs on,
+// like containerd://1.7.2. The node is named by NODE_NAME, which a pod sets from spec.nodeName with the
+// downward API; the hostname of a pod is its own name so only outside a pod it defaults to the hostname.
+func nodeRuntimeVersion(ctx context.Context, kubeconfigPath string, o *options) (string, error) {
+	nodeName := os.Getenv(nodeNameEnv)
+	if nodeName == "" {
+		if os.Getenv(kubernetesServiceHost) != "" {
+			return "", fmt.Errorf("%s is not set, a pod has to set it from spec.nodeName with the downward API", nodeNameEnv)
+		}
+		var err error
+		if nodeName, err = os.Hostname(); err != nil {
+			return "", err
+		}
+	}
+	api, err := newAPIServer(kubeconfigPath)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(ctx, o.timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, strings.TrimRight(api.server, "/")+"/api/v1/nodes/"+strings.ToLower(nodeName), nil)
+	if err != nil {
+		return "", err
+	}
+	if api.token != "" {
+		req.Header.Set("Authorization", "Bearer "+api.token)
+	}
+	// the access is read afresh by every detection, its connection is not kept for the next one
+	transport := &http.Transport{TLSClientConfig: api.tlsConfig}
+	defer transport.CloseIdleConnections()
+	httpClient := http.Client{Transport: transport}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("get node %s: %s", nodeName, resp.Status)
+	}
+	var node struct {
+		Status struct {
+			NodeInfo struct {
+				ContainerRuntimeVersion string `json:"containerRuntimeVersion"`
+			} `json:"nodeInfo"`
+		} `json:"status"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&node); err != nil {
+		return "", err
+	}
+	if node.Status.NodeInfo.ContainerRuntimeVersion == "" {
+		return "", fmt.Errorf("node %s: no containerRuntimeVersion", nodeName)
+	}
+	return node.Status.NodeInfo.ContainerRuntimeVersion, nil
+}
+
+// kubeletDetection selects the runtime the kubelet declares when it answers, nil otherwise
+func kubeletDetection(ctx context.Context, o *options) *Detection {
+	signal := kubeletRuntime(ctx, o)
+	if signal == nil {
+		return nil
+	}
+	if o.runtime != "" && signal.Runtime != "" && signal.Runtime != o.runtime {
+		logrus.Infof("kubelet uses %s from %s, not the requested %s", signal.Runtime, signal.Source, o.runtime)
+		return nil
+	}
+	kubeletOptions := *o
+	if signal.Runtime != "" {
+		kubeletOptions.runtime = signal.Runtime
+	}
+	if signal.Endpoint != "" {
+		kubeletOptions.endpoint = signal.Endpoint
+	}
+	candidates := probeAll(ctx, &kubeletOptions)
+	for _, candidate := range candidates {
+		if candidate.Reachable && !candidate.CRIOnly {
+			return &Detection{
+				DetectedRuntime: candidate,
+				Rule:            RuleKubeletConfigured,
+				Reason:          fmt.Sprintf("%s on %s is the runtime of the kubelet according to %s", candidate.Runtime, candidate.Endpoint, signal.Source),
+				Candidates:      candidates,
+			}
+		}
+	}
+	logrus.Infof("the runtime of the kubelet according to %s does not answer, probing the sockets", signal.Source)
+	return nil
+}
@@ -0,0 +1,59 @@
+package vessel
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseFlags(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want map[string]string
+	}{
+		{
+			name: "flag=value",
+			args: []string{"--container-runtime-endpoint=unix:///run/containerd/containerd.sock", "--config=/var/lib/kubelet/config.yaml"},
+			want: map[string]string{
+				"--container-runtime-endpoint": "unix:///run/containerd/containerd.sock",
+				"--config":                     "/var/lib/kubelet/config.yaml",
+			},
+		},
+		{
+			name: "flag value",
+			args: []string{"--container-runtime-endpoint", "unix:///var/run/crio/crio.sock", "--v", "2"},
+			want: map[string]string{"--container-runtime-endpoint": "unix:///var/run/crio/crio.sock", "--v": "2"},
+		},
+		{
+			name: "boolean flag before another flag",
+			args: []string{"--rotate-certificates", "--config", "/etc/kubelet.yaml"},
+			want: map[string]string{"--config": "/etc/kubelet.yaml"},
+		},
+		{
+			name: "value containing =",
+			args: []string{"--node-labels=role=worker"},
+			want: map[string]string{"--node-labels": "role=worker"},
+		},
+		{
+			name: "k3s kubelet args",
+			args: []string{"server", "--kubelet-arg=container-runtime-endpoint=unix:///run/k3s/containerd/containerd.sock", "--kubelet-arg=--config=/etc/k3s/kubelet.yaml"},
+			want: map[string]string{
+				"--kubelet-arg":                "--config=/etc/k3s/kubelet.yaml",
+				"--container-runtime-endpoint": "unix:///run/k3s/containerd/containerd.sock",
+				"--config":                     "/etc/k3s/kubelet.yaml",
+			},
+		},
+		{
+			name: "positional arguments",
+			args: []string{"agent", "extra"},
+			want: map[string]string{},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := parseFlags(tt.args); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("parseFlags(%q) = %v, want %v", tt.args, got, tt.want)
+			}
+		})
+	}
+}
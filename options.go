@@ -0,0 +1,181 @@
+package vessel
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/deepfence/vessel/utils"
+)
+
+const (
+	// RuntimeEnv and EndpointEnv are the variables cmd/vessel writes the detected runtime to
+	RuntimeEnv  = "CONTAINER_RUNTIME"
+	EndpointEnv = "CRI_ENDPOINT"
+)
+
+// DefaultOrder is the order runtimes are preferred in when several run containers,
+// docker comes before containerd whose moby namespace holds the docker containers
+var DefaultOrder = []string{utils.DOCKER, utils.CONTAINERD, utils.CRIO, utils.PODMAN}
+
+// Option configures NewRuntimeWithOptions
+type Option func(*options)
+
+type options struct {
+	runtime       string
+	endpoint      string
+	preference    []string
+	preferKubelet bool
+	kubeconfig    string
+	tls           *utils.TLSConfig
+	insecure      bool
+	sshIdentity   string
+	namespace     string
+	timeout       time.Duration
+}
+
+func newOptions(opts ...Option) *options {
+	o := &options{timeout: utils.Timeout, preferKubelet: true, tls: utils.TLSFromEnv()}
+	for _, opt := range opts {
+		opt(o)
+	}
+	if o.insecure {
+		insecure := utils.TLSConfig{}
+		if o.tls != nil {
+			insecure = *o.tls
+		}
+		insecure.Insecure = true
+		o.tls = &insecure
+	}
+	return o
+}
+
+// WithRuntime forces the runtime kind: docker, containerd, crio or podman
+func WithRuntime(runtime string) Option {
+	return func(o *options) {
+		o.runtime = runtime
+	}
+}
+
+// WithEndpoint uses endpoint instead of the well known sockets, unix:// and tcp:// are accepted,
+// and ssh:// for podman
+func WithEndpoint(endpoint string) Option {
+	return func(o *options) {
+		o.endpoint = endpoint
+	}
+}
+
+// WithPreference sets the order runtimes are preferred in, runtimes left out are not probed
+func WithPreference(runtimes ...string) Option {
+	return func(o *options) {
+		o.preference = runtimes
+	}
+}
+
+// WithKubeletPreference turns the kubelet rules on or off, they are on by default:
+// the runtime the kubelet declares first, then the runtime running the containers of the kubelet
+func WithKubeletPreference(prefer bool) Option {
+	return func(o *options) {
+		o.preferKubelet = prefer
+	}
+}
+
+// WithKubeconfig reads the node object through the kubeconfig at path, by default
+// KUBECONFIG, the kubeconfig of the kubelet or the service account of the pod are used
+func WithKubeconfig(path string) Option {
+	return func(o *options) {
+		o.kubeconfig = path
+	}
+}
+
+// WithTLS sets the client certificates for docker and podman daemons on tcp:// endpoints,
+// the ones of DOCKER_CERT_PATH are used by default
+func WithTLS(tlsConfig *utils.TLSConfig) Option {
+	return func(o *options) {
+		o.tls = tlsConfig
+	}
+}
+
+// WithInsecureTLS skips the verification of the certificate of docker daemons on tcp:// endpoints,
+// which is verified by default. Podman can not skip it, the option is refused with podman endpoints.
+func WithInsecureTLS() Option {
+	return func(o *options) {
+		o.insecure = true
+	}
+}
+
+// WithSSHIdentity sets the private key podman authenticates with on ssh:// endpoints
+func WithSSHIdentity(path string) Option {
+	return func(o *options) {
+		o.sshIdentity = path
+	}
+}
+
+// WithNamespace restricts the operations of a containerd runtime to namespace, they search every namespace by default.
+// It has no effect on the other runtimes.
+func WithNamespace(namespace string) Option {
+	return func(o *options) {
+		o.namespace = namespace
+	}
+}
+
+// WithTimeout bounds every probe of the detection
+func WithTimeout(timeout time.Duration) Option {
+	return func(o *options) {
+		o.timeout = timeout
+	}
+}
+
+// FromEnv takes the runtime and endpoint from CONTAINER_RUNTIME and CRI_ENDPOINT,
+// as written by cmd/vessel, unset variables leave the options untouched
+func FromEnv() Option {
+	return func(o *options) {
+		if runtime := os.Getenv(RuntimeEnv); runtime != "" {
+			o.runtime = runtime
+		}
+		if endpoint := os.Getenv(EndpointEnv); endpoint != "" {
+			o.endpoint = endpoint
+		}
+	}
+}
+
+// errInsecurePodman is returned when WithInsecureTLS is given for podman, which has no flag to skip the verification
+var errInsecurePodman = errors.New("podman does not support skipping the verification of the daemon certificate")
+
+// order returns the runtimes to probe, in order of preference
+func (o *options) order() []string {
+	if o.runtime != "" {
+		return []string{o.runtime}
+	}
+	if len(o.preference) > 0 {
+		return o.preference
+	}
+	return DefaultOrder
+}
+
+func (o *options) validate() error {
+	for _, runtime := range append([]string{o.runtime}, o.preference...) {
+		if runtime != "" && !slices.Contains(DefaultOrder, runtime) {
+			return fmt.Errorf("unknown container runtime %s", runtime)
+		}
+	}
+	if o.endpoint != "" && !strings.HasPrefix(o.endpoint, "unix://") && !utils.IsTCPEndpoint(o.endpoint) && !utils.IsSSHEndpoint(o.endpoint) {
+		return fmt.Errorf("endpoint %s: only unix://, tcp:// and ssh:// are supported", o.endpoint)
+	}
+	if utils.IsSSHEndpoint(o.endpoint) && o.runtime != "" && o.runtime != utils.PODMAN {
+		return fmt.Errorf("endpoint %s: only podman is reachable over ssh", o.endpoint)
+	}
+	if o.insecure && (o.runtime == utils.PODMAN || utils.IsSSHEndpoint(o.endpoint)) {
+		return errInsecurePodman
+	}
+	if o.runtime == utils.CONTAINERD && strings.HasPrefix(o.endpoint, "tcp://") {
+		return fmt.Errorf("endpoint %s: containerd is only reachable over a unix socket", o.endpoint)
+	}
+	if o.timeout <= 0 {
+		return fmt.Errorf("invalid timeout %s", o.timeout)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package vessel
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/deepfence/vessel/utils"
+)
+
+func TestWithInsecureTLS(t *testing.T) {
+	certs := utils.TLSFromCertPath("/certs")
+	for _, opts := range [][]Option{
+		{WithTLS(certs), WithInsecureTLS()},
+		{WithInsecureTLS(), WithTLS(certs)},
+	} {
+		o := newOptions(opts...)
+		if o.tls == nil || !o.tls.Insecure || o.tls.CAFile != certs.CAFile {
+			t.Fatalf("tls config %+v", o.tls)
+		}
+	}
+	if certs.Insecure {
+		t.Fatal("WithInsecureTLS changed the config given to WithTLS")
+	}
+	if o := newOptions(WithTLS(certs)); o.tls.Insecure {
+		t.Fatal("verification skipped without WithInsecureTLS")
+	}
+	for _, opts := range [][]Option{
+		{WithRuntime(utils.PODMAN), WithInsecureTLS()},
+		{WithEndpoint("ssh://core@host/run/podman/podman.sock"), WithInsecureTLS()},
+	} {
+		if err := newOptions(opts...).validate(); !errors.Is(err, errInsecurePodman) {
+			t.Fatalf("podman with WithInsecureTLS validated as %v", err)
+		}
+	}
+}
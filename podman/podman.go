@@ -1,23 +1,45 @@
 package podman
 
 import (
-	"bufio"
 	"bytes"
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
 	"os/exec"
 	"strings"
+	"time"
 
+	"github.com/containerd/platforms"
+	"github.com/deepfence/vessel/errdefs"
+	"github.com/deepfence/vessel/types"
 	"github.com/deepfence/vessel/utils"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/sirupsen/logrus"
 )
 
 // New instantiates a new Podman runtime object
 func New(endpoint string) *Podman {
+	return NewRemote(endpoint, utils.TLSFromEnv(), "")
+}
+
+// NewRemote instantiates a Podman runtime object for a service which may not be on a local socket,
+// tlsConfig is used for tcp:// endpoints and the identity file for ssh:// ones
+func NewRemote(endpoint string, tlsConfig *utils.TLSConfig, identity string) *Podman {
 	return &Podman{
 		socketPath: endpoint,
+		tls:        tlsConfig,
+		identity:   identity,
+		store:      &storeRoot{},
 	}
 }
 
+// command returns the podman command running args against the service
+func (d Podman) command(ctx context.Context, args ...string) *exec.Cmd {
+	return exec.CommandContext(ctx, "podman", append(utils.PodmanRemoteArgs(d.socketPath, d.tls, d.identity), args...)...)
+}
+
 // GetSocket is socket getter
 func (d Podman) GetSocket() string {
 	return d.socketPath
@@ -25,20 +47,55 @@ func (d Podman) GetSocket() string {
 
 // ImageExists checks if the image exists
 func (d Podman) ImageExists(imageName string) bool {
-	_, err := exec.Command("podman", "--remote", "--url", d.socketPath, "inspect", imageName).Output()
+	return d.ImageExistsContext(context.Background(), imageName)
+}
+
+// ImageExistsContext checks if the image exists, a service failing to answer is logged and reported as missing
+func (d Podman) ImageExistsContext(ctx context.Context, imageName string) bool {
+	location, err := d.LookupImage(ctx, imageName)
 	if err != nil {
-		return false
+		logrus.Debug(err.Error())
+	}
+	return location != nil
+}
+
+// LookupImage finds the image by name, id or digest, the store is the graph root of the service,
+// read with podman info on the first lookup only
+func (d Podman) LookupImage(ctx context.Context, imageName string) (_ *types.ImageLocation, err error) {
+	defer errdefs.Annotate(ctx, &err, utils.PODMAN, "lookup image", imageName, errdefs.ErrImageNotFound)
+	output, err := d.command(ctx, "image", "inspect", "--format", "{{.Id}}", imageName).Output()
+	if errdefs.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("podman image inspect %s: %w", imageName, err)
+	}
+	location := &types.ImageLocation{ID: strings.TrimSpace(string(output)), Store: d.store.get()}
+	if location.Store == "" {
+		if info, err := d.Info(ctx); err == nil {
+			location.Store = info.RootDir
+			d.store.set(location.Store)
+		}
 	}
-	return true
+	return location, nil
 }
 
 // ExtractImage creates the tarball out of image and extracts it
 func (d Podman) ExtractImage(imageID, imageName, path string) error {
+	return d.ExtractImageContext(context.Background(), imageID, imageName, path)
+}
+
+// ExtractImageContext creates the tarball out of image and extracts it
+func (d Podman) ExtractImageContext(ctx context.Context, imageID, imageName, path string) (err error) {
+	defer errdefs.Annotate(ctx, &err, utils.PODMAN, "extract image", imageName, errdefs.ErrImageNotFound)
 	var stderr bytes.Buffer
-	save := exec.Command("podman", "--remote", "--url", d.socketPath, "save", imageID)
+	save := d.command(ctx, "save", imageID)
 	save.Stderr = &stderr
-	extract := exec.Command("tar", "xf", "-", "--warning=none", "-C"+path)
+	extract := exec.CommandContext(ctx, "tar", "xf", "-", "--warning=none", "-C"+path)
 	extract.Stderr = &stderr
+	if err := errors.Join(errdefs.CommandError(save), errdefs.CommandError(extract)); err != nil {
+		return err
+	}
 	pipe, err := extract.StdinPipe()
 	if err != nil {
 		return err
@@ -47,11 +104,13 @@ func (d Podman) ExtractImage(imageID, imageName, path string) error {
 
 	err = extract.Start()
 	if err != nil {
-		return errors.New(stderr.String())
+		return fmt.Errorf("tar: %w: %s", err, stderr.String())
 	}
 	err = save.Run()
 	if err != nil {
-		return errors.New(stderr.String())
+		pipe.Close()
+		extract.Wait()
+		return fmt.Errorf("podman save %s: %w: %s", imageID, err, stderr.String())
 	}
 	err = pipe.Close()
 	if err != nil {
@@ -59,73 +118,375 @@ func (d Podman) ExtractImage(imageID, imageName, path string) error {
 	}
 	err = extract.Wait()
 	if err != nil {
-		return errors.New(stderr.String())
+		return fmt.Errorf("tar: %w: %s", err, stderr.String())
 	}
 	return nil
 }
 
 // GetImageID returns the image id
 func (d Podman) GetImageID(imageName string) ([]byte, error) {
-	return exec.Command("podman", "--remote", "--url", d.socketPath, "images", "-q", "--no-trunc", imageName).Output()
+	return d.GetImageIDContext(context.Background(), imageName)
+}
+
+// GetImageIDContext returns the image id
+func (d Podman) GetImageIDContext(ctx context.Context, imageName string) (_ []byte, err error) {
+	defer errdefs.Annotate(ctx, &err, utils.PODMAN, "image id", imageName, errdefs.ErrImageNotFound)
+	return d.command(ctx, "images", "-q", "--no-trunc", imageName).Output()
 }
 
 // Save just saves image using -o flag
 func (d Podman) Save(imageName, outputParam string) ([]byte, error) {
-	return exec.Command("podman", "--remote", "--url", d.socketPath, "save", imageName, "-o", outputParam).Output()
+	return d.SaveContext(context.Background(), imageName, outputParam)
 }
 
-// ExtractFileSystem Extract the file system from tar of an image by creating a temporary dormant container instance
+// SaveContext just saves image using -o flag
+func (d Podman) SaveContext(ctx context.Context, imageName, outputParam string) (_ []byte, err error) {
+	defer errdefs.Annotate(ctx, &err, utils.PODMAN, "save", imageName, errdefs.ErrImageNotFound)
+	return d.command(ctx, "save", imageName, "-o", outputParam).Output()
+}
+
+// SaveTo streams the image archive podman save writes to stdout to w
+func (d Podman) SaveTo(ctx context.Context, imageName string, w io.Writer) (err error) {
+	defer errdefs.Annotate(ctx, &err, utils.PODMAN, "save", imageName, errdefs.ErrImageNotFound)
+	cmd := d.command(ctx, "save", imageName)
+	return utils.RunCommandTo(cmd, w, "podman save: "+imageName+": ")
+}
+
+// ExtractFileSystem Extract the file system from tar of an image by merging its layers
 func (d Podman) ExtractFileSystem(imageTarPath string, outputTarPath string, imageName string) error {
-	imageMsg, err := utils.RunCommand(exec.Command("podman", "--remote", "--url", d.socketPath, "load", "-i", imageTarPath), "podman load: "+imageTarPath)
+	return d.ExtractFileSystemContext(context.Background(), imageTarPath, outputTarPath, imageName)
+}
+
+// ExtractFileSystemContext Extract the file system from tar of an image by merging its layers,
+// the podman service is not involved so nothing is loaded or created on it
+func (d Podman) ExtractFileSystemContext(ctx context.Context, imageTarPath string, outputTarPath string, imageName string) (err error) {
+	defer errdefs.Annotate(ctx, &err, utils.PODMAN, "extract file system", imageName, nil)
+	err = utils.FlattenImageTar(ctx, imageTarPath, outputTarPath)
+	if err != nil {
+		return fmt.Errorf("extract file system of %s from %s: %w", imageName, imageTarPath, err)
+	}
+	return nil
+}
+
+// ExtractFileSystemContainer Extract the file system of an existing container to tar
+func (d Podman) ExtractFileSystemContainer(containerId string, namespace string, outputTarPath string) error {
+	return d.ExtractFileSystemContainerContext(context.Background(), containerId, namespace, outputTarPath)
+}
+
+// ExtractFileSystemContainerContext Extract the file system of an existing container to tar
+func (d Podman) ExtractFileSystemContainerContext(ctx context.Context, containerId string, namespace string, outputTarPath string) (err error) {
+	defer errdefs.Annotate(ctx, &err, utils.PODMAN, "export container", containerId, errdefs.ErrContainerNotFound)
+	cmd := d.command(ctx, "export", strings.TrimSpace(containerId), "-o", outputTarPath)
+	_, err = utils.RunCommand(cmd, "podman export: "+string(containerId))
 	if err != nil {
 		return err
 	}
-	var imageId = ""
-	scanner := bufio.NewScanner(imageMsg)
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.Contains(line, "Loaded image") {
-			splits := strings.SplitAfterN(line, ":", 2)
-			if len(splits) > 1 {
-				imageId = strings.TrimSpace(splits[1])
-				break
-			}
+	return nil
+}
+
+// ExportContainerTo streams the file system of the container as a tar to w
+func (d Podman) ExportContainerTo(ctx context.Context, containerId string, namespace string, w io.Writer) (err error) {
+	defer errdefs.Annotate(ctx, &err, utils.PODMAN, "export container", containerId, errdefs.ErrContainerNotFound)
+	cmd := d.command(ctx, "export", strings.TrimSpace(containerId))
+	return utils.RunCommandTo(cmd, w, "podman export: "+containerId+": ")
+}
+
+// GetFileSystemPathsForContainer returns the container name and its merged dir separated by a tab
+func (d Podman) GetFileSystemPathsForContainer(containerId string, namespace string) ([]byte, error) {
+	info, err := d.InspectContainer(context.Background(), strings.TrimSpace(containerId), namespace)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(info.Name + "\t" + info.RootFS + "\n"), nil
+}
+
+// podmanContainer is an entry of podman ps --format json
+type podmanContainer struct {
+	Id      string
+	Names   []string
+	Image   string
+	ImageID string
+	State   string
+	Labels  map[string]string
+	Created int64
+	PodName string
+}
+
+// ListContainers returns all the containers of the podman service, stopped ones included
+func (d Podman) ListContainers(ctx context.Context) (_ []types.Container, err error) {
+	defer errdefs.Annotate(ctx, &err, utils.PODMAN, "list containers", "", nil)
+	output, err := utils.RunCommand(d.command(ctx, "ps", "--all", "--format", "json"), "podman ps: ")
+	if err != nil {
+		return nil, err
+	}
+	var podmanContainers []podmanContainer
+	if err := json.Unmarshal(output.Bytes(), &podmanContainers); err != nil {
+		return nil, fmt.Errorf("podman ps: %w", err)
+	}
+	containers := make([]types.Container, 0, len(podmanContainers))
+	for _, pc := range podmanContainers {
+		c := types.Container{
+			ID:          pc.Id,
+			Image:       pc.Image,
+			ImageDigest: pc.ImageID,
+			State:       containerState(pc.State),
+			Labels:      pc.Labels,
+			PodName:     pc.PodName,
+			Created:     time.Unix(pc.Created, 0),
+		}
+		if len(pc.Names) > 0 {
+			c.Name = pc.Names[0]
 		}
+		c.SetPodFromLabels()
+		containers = append(containers, c)
 	}
-	if imageId == "" {
-		return errors.New("image not found from podman load with output: " + imageMsg.String())
+	return containers, nil
+}
+
+// containerState maps the podman container states onto the normalized ones
+func containerState(state string) string {
+	switch strings.ToLower(state) {
+	case "created", "configured", "initialized":
+		return types.ContainerStateCreated
+	case "running", "restarting":
+		return types.ContainerStateRunning
+	case "paused":
+		return types.ContainerStatePaused
+	case "exited", "stopped", "stopping", "removing":
+		return types.ContainerStateExited
 	}
-	containerOutput, err := utils.RunCommand(exec.Command("podman", "--remote", "--url", d.socketPath, "create", imageId), "podman create: "+imageId)
-	if err != nil {
-		return err
+	return types.ContainerStateUnknown
+}
+
+// podmanImage is an entry of podman images --format json
+type podmanImage struct {
+	Id          string
+	RepoTags    []string
+	RepoDigests []string
+	Size        int64
+	Created     int64
+}
+
+// podmanImageInspect is an entry of podman image inspect --format json
+type podmanImageInspect struct {
+	Id           string
+	RepoTags     []string
+	RepoDigests  []string
+	Created      time.Time
+	Size         int64
+	Os           string
+	Architecture string
+	Variant      string
+	Config       ocispec.ImageConfig
+	RootFS       struct {
+		Layers []string
 	}
-	containerId := strings.TrimSpace(containerOutput.String())
-	_, err = utils.RunCommand(exec.Command("podman", "--remote", "--url", d.socketPath, "export", strings.TrimSpace(containerId), "-o", outputTarPath), "podman export: "+string(containerId))
+	History []ocispec.History
+}
+
+// ListImages returns the images of the podman service
+func (d Podman) ListImages(ctx context.Context) (_ []types.Image, err error) {
+	defer errdefs.Annotate(ctx, &err, utils.PODMAN, "list images", "", nil)
+	output, err := utils.RunCommand(d.command(ctx, "images", "--format", "json"), "podman images: ")
 	if err != nil {
-		return err
+		return nil, err
+	}
+	var podmanImages []podmanImage
+	if err := json.Unmarshal(output.Bytes(), &podmanImages); err != nil {
+		return nil, fmt.Errorf("podman images: %w", err)
+	}
+	imagePlatforms := d.imagePlatforms(ctx, podmanImages)
+	images := make([]types.Image, 0, len(podmanImages))
+	for _, pi := range podmanImages {
+		images = append(images, types.Image{
+			ID:           pi.Id,
+			RepoTags:     pi.RepoTags,
+			RepoDigests:  pi.RepoDigests,
+			ConfigDigest: "sha256:" + strings.TrimPrefix(pi.Id, "sha256:"),
+			Size:         pi.Size,
+			Created:      time.Unix(pi.Created, 0),
+			Platform:     imagePlatforms[pi.Id],
+		})
 	}
-	_, err = utils.RunCommand(exec.Command("podman", "--remote", "--url", d.socketPath, "container", "rm", containerId), "delete container:"+containerId)
+	return images, nil
+}
+
+// imagePlatforms inspects the images at once since podman images does not report platforms
+func (d Podman) imagePlatforms(ctx context.Context, podmanImages []podmanImage) map[string]string {
+	imagePlatforms := map[string]string{}
+	if len(podmanImages) == 0 {
+		return imagePlatforms
+	}
+	args := []string{"image", "inspect", "--format", "json"}
+	for _, pi := range podmanImages {
+		args = append(args, pi.Id)
+	}
+	output, err := utils.RunCommand(d.command(ctx, args...), "podman image inspect: ")
 	if err != nil {
-		logrus.Warn(err.Error())
+		logrus.Debug(err.Error())
+		return imagePlatforms
+	}
+	var inspects []podmanImageInspect
+	if err := json.Unmarshal(output.Bytes(), &inspects); err != nil {
+		logrus.Debugf("podman image inspect: %s", err.Error())
+		return imagePlatforms
+	}
+	for _, inspect := range inspects {
+		imagePlatforms[inspect.Id] = platforms.Format(ocispec.Platform{OS: inspect.Os, Architecture: inspect.Architecture, Variant: inspect.Variant})
 	}
-	_, err = utils.RunCommand(exec.Command("podman", "--remote", "--url", d.socketPath, "image", "rm", imageId), "delete image:"+imageId)
+	return imagePlatforms
+}
+
+// InspectImage returns the config, layers and history of the image
+func (d Podman) InspectImage(ctx context.Context, imageName string) (_ *types.ImageInspect, err error) {
+	defer errdefs.Annotate(ctx, &err, utils.PODMAN, "inspect image", imageName, errdefs.ErrImageNotFound)
+	output, err := utils.RunCommand(d.command(ctx, "image", "inspect", "--format", "json", imageName), "podman image inspect: ")
 	if err != nil {
-		logrus.Warn(err.Error())
+		return nil, err
 	}
-	return nil
+	var inspects []podmanImageInspect
+	if err := json.Unmarshal(output.Bytes(), &inspects); err != nil {
+		return nil, fmt.Errorf("podman image inspect: %w", err)
+	}
+	if len(inspects) == 0 {
+		return nil, fmt.Errorf("podman image inspect: %w: %s", errdefs.ErrImageNotFound, imageName)
+	}
+	inspect := inspects[0]
+	return &types.ImageInspect{
+		Image: types.Image{
+			ID:           inspect.Id,
+			RepoTags:     inspect.RepoTags,
+			RepoDigests:  inspect.RepoDigests,
+			ConfigDigest: "sha256:" + strings.TrimPrefix(inspect.Id, "sha256:"),
+			Size:         inspect.Size,
+			Created:      inspect.Created,
+			Platform:     platforms.Format(ocispec.Platform{OS: inspect.Os, Architecture: inspect.Architecture, Variant: inspect.Variant}),
+		},
+		Config:  inspect.Config,
+		DiffIDs: inspect.RootFS.Layers,
+		History: inspect.History,
+	}, nil
 }
 
-// ExtractFileSystemContainer Extract the file system of an existing container to tar
-func (d Podman) ExtractFileSystemContainer(containerId string, namespace string, outputTarPath string) error {
-	cmd := exec.Command("podman", "--remote", "--url", d.socketPath, "export", strings.TrimSpace(containerId), "-o", outputTarPath)
-	_, err := utils.RunCommand(cmd, "podman export: "+string(containerId))
+// podmanContainerInspect is an entry of podman container inspect --format json
+type podmanContainerInspect struct {
+	Id        string
+	Name      string
+	Created   time.Time
+	Image     string
+	ImageName string
+	Pod       string
+	State     struct {
+		Status     string
+		Running    bool
+		Pid        int
+		CgroupPath string
+	}
+	GraphDriver struct {
+		Name string
+		Data map[string]string
+	}
+	Mounts []struct {
+		Type        string
+		Source      string
+		Destination string
+		Options     []string
+		RW          bool
+	}
+	Config struct {
+		Env    []string
+		Labels map[string]string
+	}
+}
+
+// InspectContainer returns the rootfs, storage, mounts and process details of the container
+func (d Podman) InspectContainer(ctx context.Context, containerId string, namespace string) (_ *types.ContainerInspect, err error) {
+	defer errdefs.Annotate(ctx, &err, utils.PODMAN, "inspect container", containerId, errdefs.ErrContainerNotFound)
+	output, err := utils.RunCommand(d.command(ctx, "container", "inspect", "--format", "json", containerId), "podman container inspect: ")
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	var inspects []podmanContainerInspect
+	if err := json.Unmarshal(output.Bytes(), &inspects); err != nil {
+		return nil, fmt.Errorf("podman container inspect: %w", err)
+	}
+	if len(inspects) == 0 {
+		return nil, fmt.Errorf("podman container inspect: %w: %s", errdefs.ErrContainerNotFound, containerId)
+	}
+	inspect := inspects[0]
+	result := &types.ContainerInspect{
+		Container: types.Container{
+			ID:          inspect.Id,
+			Name:        inspect.Name,
+			Image:       inspect.ImageName,
+			ImageDigest: inspect.Image,
+			State:       containerState(inspect.State.Status),
+			Labels:      inspect.Config.Labels,
+			Created:     inspect.Created,
+		},
+		Snapshotter: inspect.GraphDriver.Name,
+		StorageData: inspect.GraphDriver.Data,
+		Pid:         inspect.State.Pid,
+		CgroupPath:  inspect.State.CgroupPath,
+		Env:         inspect.Config.Env,
+		SandboxID:   inspect.Pod,
+	}
+	// the storage only keeps MergedDir mounted while the container runs
+	if inspect.State.Running {
+		result.RootFS = utils.HostPath(inspect.GraphDriver.Data["MergedDir"])
+	}
+	for _, mount := range inspect.Mounts {
+		result.Mounts = append(result.Mounts, types.Mount{
+			Type:        mount.Type,
+			Source:      mount.Source,
+			Destination: mount.Destination,
+			Options:     mount.Options,
+			ReadOnly:    !mount.RW,
+		})
+	}
+	result.SetPodFromLabels()
+	return result, nil
 }
 
-// ExtractFileSystemContainer Extract the file system of an existing container to tar
-func (d Podman) GetFileSystemPathsForContainer(containerId string, namespace string) ([]byte, error) {
-	return exec.Command("podman", "--remote", "--url", d.socketPath, "inspect", strings.TrimSpace(containerId), "|", "jq", "-r", "'map([.Name, .GraphDriver.Data.MergedDir]) | .[] | \"\\(.[0])\t\\(.[1])\"'").Output()
+// podmanInfo is the part of podman info --format json describing the service
+type podmanInfo struct {
+	Host struct {
+		Arch          string
+		OS            string
+		CgroupManager string
+		CgroupVersion string
+	}
+	Store struct {
+		GraphDriverName string
+		GraphRoot       string
+	}
+	Version struct {
+		Version    string
+		APIVersion string
+	}
+}
+
+// Info returns the version, API version, storage, cgroup and platform of the service
+func (d Podman) Info(ctx context.Context) (_ *types.RuntimeInfo, err error) {
+	defer errdefs.Annotate(ctx, &err, utils.PODMAN, "info", "", nil)
+	output, err := utils.RunCommand(d.command(ctx, "info", "--format", "json"), "podman info: ")
+	if err != nil {
+		return nil, err
+	}
+	var info podmanInfo
+	if err := json.Unmarshal(output.Bytes(), &info); err != nil {
+		return nil, fmt.Errorf("podman info: %w", err)
+	}
+	return &types.RuntimeInfo{
+		Runtime:       utils.PODMAN,
+		Endpoint:      d.socketPath,
+		Version:       info.Version.Version,
+		APIVersion:    info.Version.APIVersion,
+		StorageDriver: info.Store.GraphDriverName,
+		CgroupDriver:  info.Host.CgroupManager,
+		CgroupVersion: info.Host.CgroupVersion,
+		RootDir:       info.Store.GraphRoot,
+		OS:            info.Host.OS,
+		Architecture:  info.Host.Arch,
+	}, nil
 }
@@ -1,5 +1,39 @@
 package podman
 
+import (
+	"sync"
+
+	"github.com/deepfence/vessel/utils"
+)
+
 type Podman struct {
 	socketPath string
+	tls        *utils.TLSConfig
+	identity   string
+	store      *storeRoot
+}
+
+// storeRoot caches the graph root of the service LookupImage reports, it is shared by the copies of a Podman.
+// A Podman not made by New has none, the graph root is then read on every lookup.
+type storeRoot struct {
+	mu   sync.Mutex
+	root string
+}
+
+func (s *storeRoot) get() string {
+	if s == nil {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.root
+}
+
+func (s *storeRoot) set(root string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.root = root
 }
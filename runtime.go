@@ -1,5 +1,12 @@
 package vessel
 
+import (
+	"context"
+	"io"
+
+	"github.com/deepfence/vessel/types"
+)
+
 // Runtime interface, interfaces all the container runtime methods
 type Runtime interface {
 	ExtractImage(imageID string, imageName string, path string) error
@@ -9,4 +16,34 @@ type Runtime interface {
 	ExtractFileSystem(imageTarPath string, outputTarPath string, imageName string) error
 	ExtractFileSystemContainer(containerId string, namespace string, outputTarPath string) error
 	ImageExists(imageName string) bool
+	ContextRuntime
+	// ListContainers returns every container known to the runtime, across all containerd namespaces
+	ListContainers(ctx context.Context) ([]types.Container, error)
+	// ListImages returns every image known to the runtime, across all containerd namespaces
+	ListImages(ctx context.Context) ([]types.Image, error)
+	// InspectImage returns the config, layers and history of the image
+	InspectImage(ctx context.Context, imageName string) (*types.ImageInspect, error)
+	// InspectContainer returns the rootfs, storage, mounts and process details of the container,
+	// containerd looks the container up in every namespace when namespace is empty
+	InspectContainer(ctx context.Context, containerId string, namespace string) (*types.ContainerInspect, error)
+	// SaveTo writes the image archive Save would write to w
+	SaveTo(ctx context.Context, imageName string, w io.Writer) error
+	// ExportContainerTo writes the root filesystem tar ExtractFileSystemContainer would write to w
+	ExportContainerTo(ctx context.Context, containerId string, namespace string, w io.Writer) error
+	// Info returns the version, API version, storage, cgroup and platform of the runtime
+	Info(ctx context.Context) (*types.RuntimeInfo, error)
+	// LookupImage finds the image given as a tag, a digest or an id, in every containerd namespace.
+	// A missing image is not an error, nil is returned, errors are the failures to ask the runtime.
+	LookupImage(ctx context.Context, imageName string) (*types.ImageLocation, error)
+}
+
+// ContextRuntime interfaces the context aware variants of the Runtime methods,
+// cancelling the context aborts the operation and cleans up what it created
+type ContextRuntime interface {
+	ExtractImageContext(ctx context.Context, imageID string, imageName string, path string) error
+	GetImageIDContext(ctx context.Context, imageName string) ([]byte, error)
+	SaveContext(ctx context.Context, imageName, outputParam string) ([]byte, error)
+	ExtractFileSystemContext(ctx context.Context, imageTarPath string, outputTarPath string, imageName string) error
+	ExtractFileSystemContainerContext(ctx context.Context, containerId string, namespace string, outputTarPath string) error
+	ImageExistsContext(ctx context.Context, imageName string) bool
 }
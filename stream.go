@@ -0,0 +1,24 @@
+package vessel
+
+import (
+	"context"
+	"io"
+
+	"github.com/deepfence/vessel/utils"
+)
+
+// SaveStream returns the image archive of imageName as a stream,
+// closing it before the end aborts the save
+func SaveStream(ctx context.Context, runtime Runtime, imageName string) io.ReadCloser {
+	return utils.StreamFunc(ctx, func(ctx context.Context, w io.Writer) error {
+		return runtime.SaveTo(ctx, imageName, w)
+	})
+}
+
+// ExportContainerStream returns the root filesystem tar of the container as a stream,
+// closing it before the end aborts the export
+func ExportContainerStream(ctx context.Context, runtime Runtime, containerId string, namespace string) io.ReadCloser {
+	return utils.StreamFunc(ctx, func(ctx context.Context, w io.Writer) error {
+		return runtime.ExportContainerTo(ctx, containerId, namespace, w)
+	})
+}
@@ -0,0 +1,82 @@
+package types
+
+import "time"
+
+// Container states reported by every runtime
+const (
+	ContainerStateCreated = "created"
+	ContainerStateRunning = "running"
+	ContainerStatePaused  = "paused"
+	ContainerStateExited  = "exited"
+	ContainerStateUnknown = "unknown"
+)
+
+// Kubernetes labels the kubelet puts on the containers it creates
+const (
+	PodNameLabel       = "io.kubernetes.pod.name"
+	PodNamespaceLabel  = "io.kubernetes.pod.namespace"
+	ContainerNameLabel = "io.kubernetes.container.name"
+	PodUIDLabel        = "io.kubernetes.pod.uid"
+)
+
+// Container is the runtime independent description of a container
+type Container struct {
+	ID   string
+	Name string
+	// Image is the image reference the container was created from
+	Image string
+	// ImageDigest identifies the image as reported by the runtime, the image id or the manifest digest
+	ImageDigest string
+	State       string
+	Labels      map[string]string
+	// Namespace is the containerd namespace holding the container
+	Namespace    string
+	PodName      string
+	PodNamespace string
+	Created      time.Time
+}
+
+// SetPodFromLabels fills the pod metadata from the kubernetes labels of the container
+func (c *Container) SetPodFromLabels() {
+	if name := c.Labels[PodNameLabel]; name != "" {
+		c.PodName = name
+	}
+	if namespace := c.Labels[PodNamespaceLabel]; namespace != "" {
+		c.PodNamespace = namespace
+	}
+}
+
+// Mount is a mount of a container
+type Mount struct {
+	Type        string
+	Source      string
+	Destination string
+	Options     []string
+	ReadOnly    bool
+}
+
+// ContainerInspect is the runtime independent detail of a container
+type ContainerInspect struct {
+	Container
+	// RootFS is the host path of the merged root filesystem, empty when it is not mounted
+	RootFS string
+	// Snapshotter is the containerd snapshotter or the graph driver of docker, podman and CRI-O
+	Snapshotter string
+	SnapshotKey string
+	// StorageData holds the graph driver data or the overlay options: lowerdir, upperdir, workdir...
+	StorageData map[string]string
+	Mounts      []Mount
+	Pid         int
+	CgroupPath  string
+	Env         []string
+	PodUID      string
+	SandboxID   string
+}
+
+// SetPodFromLabels fills the pod metadata from the kubernetes labels of the container
+func (c *ContainerInspect) SetPodFromLabels() {
+	c.Container.SetPodFromLabels()
+	if uid := c.Labels[PodUIDLabel]; uid != "" {
+		c.PodUID = uid
+	}
+}
@@ -0,0 +1,58 @@
+package types
+
+import (
+	"time"
+
+	"github.com/containerd/platforms"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Image is the runtime independent description of an image
+type Image struct {
+	// ID is the id the runtime knows the image by, the manifest digest for containerd
+	ID           string
+	RepoTags     []string
+	RepoDigests  []string
+	ConfigDigest string
+	Size         int64
+	Created      time.Time
+	// Platform is formatted as os/architecture[/variant], the docker image list leaves it empty
+	Platform string
+	// Namespace is the containerd namespace holding the image
+	Namespace string
+}
+
+// ImageInspect is the runtime independent detail of an image
+type ImageInspect struct {
+	Image
+	// Config is the execution config of the image: env, entrypoint, cmd, user, exposed ports, labels...
+	Config  ocispec.ImageConfig
+	DiffIDs []string
+	History []ocispec.History
+}
+
+// SetFromOCIConfig fills the inspect from the OCI image config
+func (i *ImageInspect) SetFromOCIConfig(config ocispec.Image) {
+	i.Config = config.Config
+	i.History = config.History
+	i.DiffIDs = make([]string, 0, len(config.RootFS.DiffIDs))
+	for _, diffID := range config.RootFS.DiffIDs {
+		i.DiffIDs = append(i.DiffIDs, diffID.String())
+	}
+	if config.Created != nil {
+		i.Created = *config.Created
+	}
+	if config.OS != "" {
+		i.Platform = platforms.Format(config.Platform)
+	}
+}
+
+// ImageLocation tells where the runtime found an image
+type ImageLocation struct {
+	// ID is the id the runtime knows the image by, the manifest digest for containerd
+	ID string
+	// Namespaces are the containerd namespaces holding the image
+	Namespaces []string
+	// Store is the root of the image store: the docker data root, the podman graph root or the CRI-O storage root
+	Store string
+}
@@ -0,0 +1,18 @@
+package types
+
+// RuntimeInfo describes the runtime vessel talks to and what it runs with
+type RuntimeInfo struct {
+	// Runtime is the kind of runtime: docker, containerd, crio or podman
+	Runtime  string
+	Endpoint string
+	Version  string
+	// APIVersion is the docker or podman API version, the CRI API version for containerd and CRI-O
+	APIVersion string
+	// StorageDriver is the graph driver of docker, podman and CRI-O, the snapshotter of containerd
+	StorageDriver string
+	CgroupDriver  string
+	CgroupVersion string
+	RootDir       string
+	OS            string
+	Architecture  string
+}
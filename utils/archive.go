@@ -0,0 +1,269 @@
+package utils
+
+import (
+	"archive/tar"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ExtractTar extracts the tar stream into dir without relying on the tar binary,
+// entries escaping dir are rejected
+func ExtractTar(r io.Reader, dir string) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		target := SecureJoin(dir, hdr.Name)
+		if err := checkParent(dir, target); err != nil {
+			return err
+		}
+		mode := os.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, mode|0700); err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := removeNonDir(target); err != nil {
+				return err
+			}
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY|syscall.O_NOFOLLOW, mode)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			f.Close()
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := removeNonDir(target); err != nil {
+				return err
+			}
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return err
+			}
+		case tar.TypeLink:
+			source := SecureJoin(dir, hdr.Linkname)
+			if err := checkParent(dir, source); err != nil {
+				return err
+			}
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := removeNonDir(target); err != nil {
+				return err
+			}
+			if err := os.Link(source, target); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// removeNonDir unlinks what an earlier entry left at target unless it is a directory,
+// writing through a symlink left there would land outside dir
+func removeNonDir(target string) error {
+	info, err := os.Lstat(target)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.IsDir() {
+		return nil
+	}
+	return os.Remove(target)
+}
+
+// SecureJoin joins name onto dir, ".." elements can not climb above dir
+func SecureJoin(dir, name string) string {
+	return filepath.Join(dir, filepath.Clean("/"+name))
+}
+
+// checkParent refuses targets whose closest existing ancestor resolves outside dir through a symlink
+func checkParent(dir, target string) error {
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	ancestor := filepath.Dir(target)
+	parent, err := filepath.EvalSymlinks(ancestor)
+	for err != nil && len(ancestor) > len(dir) {
+		ancestor = filepath.Dir(ancestor)
+		parent, err = filepath.EvalSymlinks(ancestor)
+	}
+	if err != nil {
+		return err
+	}
+	if parent != root && !strings.HasPrefix(parent, root+string(os.PathSeparator)) {
+		return fmt.Errorf("tar entry %s escapes %s", target, dir)
+	}
+	return nil
+}
+
+// WriteFile copies reader into a newly created file at path
+func WriteFile(path string, reader io.Reader) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, reader)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// WriteFileFunc creates the file at path and lets write fill it
+func WriteFileFunc(path string, write func(w io.Writer) error) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = write(file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// fileID identifies the inode shared by hardlinked files
+type fileID struct {
+	dev uint64
+	ino uint64
+}
+
+// zeros pads files which shrank while they were copied
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// tarWriter writes the entries of a tree walk, the hardlinks it saw are stored once
+type tarWriter struct {
+	tw    *tar.Writer
+	links map[fileID]string
+}
+
+func newTarWriter(w io.Writer) *tarWriter {
+	return &tarWriter{tw: tar.NewWriter(w), links: map[fileID]string{}}
+}
+
+// add writes the entry at path as rel, "." being the root. Sockets are left out
+// and an entry vanishing before its content is read is skipped.
+func (t *tarWriter) add(path, rel string, info fs.FileInfo) error {
+	if info.Mode()&fs.ModeSocket != 0 {
+		return nil
+	}
+	var linkname string
+	if info.Mode()&fs.ModeSymlink != 0 {
+		var err error
+		if linkname, err = os.Readlink(path); errors.Is(err, fs.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(info, linkname)
+	if err != nil {
+		return err
+	}
+	hdr.Name = "./" + filepath.ToSlash(rel)
+	if rel == "." {
+		hdr.Name = "./"
+	} else if info.IsDir() {
+		hdr.Name += "/"
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok && info.Mode().IsRegular() && stat.Nlink > 1 {
+		id := fileID{dev: uint64(stat.Dev), ino: uint64(stat.Ino)}
+		if first, ok := t.links[id]; ok {
+			hdr.Typeflag = tar.TypeLink
+			hdr.Linkname = first
+			hdr.Size = 0
+		} else {
+			t.links[id] = hdr.Name
+		}
+	}
+	if hdr.Typeflag != tar.TypeReg {
+		return t.tw.WriteHeader(hdr)
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := t.tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if _, err := io.Copy(t.tw, io.LimitReader(io.MultiReader(file, zeros{}), hdr.Size)); err != nil {
+		return err
+	}
+	if n, err := file.Seek(0, io.SeekCurrent); err == nil && n < hdr.Size {
+		logrus.Warnf("%s shrank while it was archived, padded with zeros", path)
+	}
+	return nil
+}
+
+func (t *tarWriter) close() error {
+	return t.tw.Close()
+}
+
+// TarDirectory writes the tree under dir to w as a tar with paths relative to dir, like tar -C dir . does.
+// Entries vanishing during the walk are skipped, sockets are left out and hardlinked files are stored once.
+func TarDirectory(ctx context.Context, dir string, w io.Writer) error {
+	t := newTarWriter(w)
+	err := filepath.WalkDir(dir, func(name string, entry fs.DirEntry, err error) error {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		info, err := entry.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, name)
+		if err != nil {
+			return err
+		}
+		return t.add(name, rel, info)
+	})
+	if err != nil {
+		return err
+	}
+	return t.close()
+}
@@ -0,0 +1,113 @@
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testEntry is an entry of the tars built by the tests
+type testEntry struct {
+	name     string
+	typeflag byte
+	linkname string
+	body     string
+}
+
+func buildTar(t *testing.T, entries []testEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Typeflag: e.typeflag, Linkname: e.linkname, Mode: 0644}
+		if e.typeflag == tar.TypeDir {
+			hdr.Mode = 0755
+		}
+		if e.typeflag == tar.TypeReg {
+			hdr.Size = int64(len(e.body))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtractTarSymlinkThenFile(t *testing.T) {
+	outside := t.TempDir()
+	victim := filepath.Join(outside, "victim")
+	if err := os.WriteFile(victim, []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	archive := buildTar(t, []testEntry{
+		{name: "a", typeflag: tar.TypeSymlink, linkname: victim},
+		{name: "a", typeflag: tar.TypeReg, body: "overwritten"},
+	})
+	if err := ExtractTar(bytes.NewReader(archive), dir); err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(victim); string(content) != "original" {
+		t.Fatalf("file outside dir overwritten: %q", content)
+	}
+	info, err := os.Lstat(filepath.Join(dir, "a"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !info.Mode().IsRegular() {
+		t.Fatalf("a is %s, want a regular file", info.Mode())
+	}
+	if content, _ := os.ReadFile(filepath.Join(dir, "a")); string(content) != "overwritten" {
+		t.Fatalf("a holds %q", content)
+	}
+}
+
+func TestExtractTarRejectsEscapes(t *testing.T) {
+	outside := t.TempDir()
+	if err := os.WriteFile(filepath.Join(outside, "victim"), []byte("original"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		entries []testEntry
+	}{
+		{"file below symlinked dir", []testEntry{
+			{name: "l", typeflag: tar.TypeSymlink, linkname: outside},
+			{name: "l/victim", typeflag: tar.TypeReg, body: "overwritten"},
+		}},
+		{"hardlink through symlinked dir", []testEntry{
+			{name: "l", typeflag: tar.TypeSymlink, linkname: outside},
+			{name: "h", typeflag: tar.TypeLink, linkname: "l/victim"},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if err := ExtractTar(bytes.NewReader(buildTar(t, tt.entries)), dir); err == nil {
+				t.Fatal("escaping entry extracted")
+			}
+			if content, _ := os.ReadFile(filepath.Join(outside, "victim")); string(content) != "original" {
+				t.Fatalf("file outside dir overwritten: %q", content)
+			}
+		})
+	}
+}
+
+func TestExtractTarDotDot(t *testing.T) {
+	dir := t.TempDir()
+	archive := buildTar(t, []testEntry{{name: "../../escaped", typeflag: tar.TypeReg, body: "x"}})
+	if err := ExtractTar(bytes.NewReader(archive), dir); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "escaped")); err != nil {
+		t.Fatalf("entry not kept below dir: %v", err)
+	}
+}
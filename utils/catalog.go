@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Endpoint is a socket a runtime is known to listen on
+type Endpoint struct {
+	Runtime string
+	// URI of the endpoint as seen from the host, * globs are expanded under the host root.
+	// A $VARIABLE is expanded from the environment of vessel and is not resolved under the host root.
+	URI string
+	// Distribution is the product the endpoint belongs to
+	Distribution string
+	// Rootless endpoints belong to a daemon running as a user
+	Rootless bool
+	// CRIOnly endpoints serve the CRI API only, like the docker shims, they are reported but never selected
+	CRIOnly bool
+}
+
+// Endpoints is the catalog of the endpoints probed by the detection, in order of preference within a runtime
+var Endpoints = []Endpoint{
+	{Runtime: DOCKER, URI: "$DOCKER_HOST", Distribution: "DOCKER_HOST"},
+	{Runtime: DOCKER, URI: DOCKER_SOCKET_URI, Distribution: "docker"},
+	{Runtime: DOCKER, URI: "unix://$XDG_RUNTIME_DIR/docker.sock", Distribution: "docker rootless", Rootless: true},
+	{Runtime: DOCKER, URI: "unix:///run/user/*/docker.sock", Distribution: "docker rootless", Rootless: true},
+	{Runtime: DOCKER, URI: "unix:///home/*/.docker/run/docker.sock", Distribution: "docker desktop", Rootless: true},
+	{Runtime: DOCKER, URI: "unix:///home/*/.colima/default/docker.sock", Distribution: "colima", Rootless: true},
+	{Runtime: DOCKER, URI: "unix:///home/*/.colima/docker.sock", Distribution: "colima", Rootless: true},
+	{Runtime: DOCKER, URI: "unix:///home/*/.lima/docker/sock/docker.sock", Distribution: "lima", Rootless: true},
+	{Runtime: DOCKER, URI: "unix:///home/*/.rd/docker.sock", Distribution: "rancher desktop", Rootless: true},
+	{Runtime: DOCKER, URI: "unix:///run/cri-dockerd.sock", Distribution: "cri-dockerd", CRIOnly: true},
+	{Runtime: DOCKER, URI: "unix:///var/run/cri-dockerd.sock", Distribution: "cri-dockerd", CRIOnly: true},
+	{Runtime: CONTAINERD, URI: CONTAINERD_SOCKET_URI, Distribution: "containerd"},
+	{Runtime: CONTAINERD, URI: K3S_CONTAINERD_SOCKET_URI, Distribution: "k3s, rke2"},
+	{Runtime: CONTAINERD, URI: "unix:///var/snap/microk8s/common/run/containerd.sock", Distribution: "microk8s"},
+	{Runtime: CONTAINERD, URI: "unix:///run/k0s/containerd.sock", Distribution: "k0s"},
+	{Runtime: CRIO, URI: CRIO_SOCKET_URI, Distribution: "cri-o"},
+	{Runtime: PODMAN, URI: "$CONTAINER_HOST", Distribution: "CONTAINER_HOST"},
+	{Runtime: PODMAN, URI: PODMAN_SOCKET_URI, Distribution: "podman"},
+	{Runtime: PODMAN, URI: "unix://$XDG_RUNTIME_DIR/podman/podman.sock", Distribution: "podman rootless", Rootless: true},
+	{Runtime: PODMAN, URI: "unix:///run/user/*/podman/podman.sock", Distribution: "podman rootless", Rootless: true},
+	{Runtime: PODMAN, URI: "unix:///home/*/.lima/podman/sock/podman.sock", Distribution: "lima", Rootless: true},
+}
+
+// SupportedRuntimes lists the endpoints of the catalog for every runtime, unexpanded
+//
+// Deprecated: use Endpoints, which carries the distribution of every endpoint
+var SupportedRuntimes = supportedRuntimes()
+
+func supportedRuntimes() map[string][]string {
+	runtimes := map[string][]string{}
+	for _, endpoint := range Endpoints {
+		runtimes[endpoint.Runtime] = append(runtimes[endpoint.Runtime], endpoint.URI)
+	}
+	return runtimes
+}
+
+// Expand returns the URIs the endpoint stands for on this host, none when a variable is unset or a glob matches nothing
+func (e Endpoint) Expand() []string {
+	if strings.Contains(e.URI, "$") {
+		missing := false
+		uri := os.Expand(e.URI, func(name string) string {
+			value := os.Getenv(name)
+			missing = missing || value == ""
+			return value
+		})
+		if missing {
+			return nil
+		}
+		return []string{uri}
+	}
+	path, ok := strings.CutPrefix(e.URI, "unix://")
+	if !ok {
+		return []string{e.URI}
+	}
+	if !strings.Contains(path, "*") {
+		return []string{HostEndpoint(e.URI)}
+	}
+	matches, _ := filepath.Glob(HostPath(path))
+	uris := make([]string, 0, len(matches))
+	for _, match := range matches {
+		uris = append(uris, "unix://"+match)
+	}
+	return uris
+}
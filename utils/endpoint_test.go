@@ -0,0 +1,36 @@
+package utils
+
+import (
+	"context"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	runtimeapi "k8s.io/cri-api/pkg/apis/runtime/v1"
+)
+
+func TestNewGRPCClientUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "cri.sock")
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := grpc.NewServer()
+	runtimeapi.RegisterRuntimeServiceServer(server, &runtimeapi.UnimplementedRuntimeServiceServer{})
+	go server.Serve(listener)
+	defer server.Stop()
+
+	conn, err := NewGRPCClient("unix://" + socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// the server answering Unimplemented proves the call went through the socket
+	_, err = runtimeapi.NewRuntimeServiceClient(conn).Version(context.Background(), &runtimeapi.VersionRequest{})
+	if status.Code(err) != codes.Unimplemented {
+		t.Fatalf("Version over %s: %v", socket, err)
+	}
+}
@@ -0,0 +1,349 @@
+package utils
+
+import (
+	"archive/tar"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/containerd/platforms"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// LayerOpener returns a fresh uncompressed tar stream of an image layer
+type LayerOpener func() (io.ReadCloser, error)
+
+// hardlink is a hardlink entry of a layer whose target lives in the same layer
+type hardlink struct {
+	name   string
+	target string
+}
+
+// layerPlan is what the first pass learns about the surviving entries of every layer
+type layerPlan struct {
+	// owner maps a path to the index of the topmost layer providing it
+	owner map[string]int
+	// dirs holds the headers of the surviving directories
+	dirs map[string]*tar.Header
+	// materialize maps, per layer, a target that does not survive to the hardlinks which do
+	materialize []map[string][]string
+}
+
+// FlattenImageTar writes the merged root filesystem of the saved image at imageTarPath to outputTarPath
+func FlattenImageTar(ctx context.Context, imageTarPath, outputTarPath string) error {
+	file, err := os.Create(outputTarPath)
+	if err != nil {
+		return err
+	}
+	err = FlattenImage(ctx, imageTarPath, file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// FlattenImage writes the merged root filesystem of the saved image at imageTarPath to w,
+// the image may be a docker-archive or an OCI image layout, as a tarball or an extracted directory.
+// Layers are applied in order and whiteouts remove what the layers below provided,
+// no runtime or privilege is needed.
+func FlattenImage(ctx context.Context, imageTarPath string, w io.Writer) error {
+	layout, closer, err := OpenImageLayout(imageTarPath)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	names, err := imageLayers(layout)
+	if err != nil {
+		return err
+	}
+	layers := make([]LayerOpener, 0, len(names))
+	for _, name := range names {
+		layers = append(layers, layerOpener(layout, name))
+	}
+	return FlattenLayers(ctx, layers, w)
+}
+
+// imageLayers lists the layer files of a docker-archive or of an OCI image layout for the host platform, lowest first
+func imageLayers(layout fs.FS) ([]string, error) {
+	if _, err := fs.Stat(layout, "manifest.json"); err == nil {
+		manifest, err := ReadDockerManifest(layout)
+		if err != nil {
+			return nil, err
+		}
+		return manifest.Layers, nil
+	}
+	var index ocispec.Index
+	if err := ReadJSON(layout, ocispec.ImageIndexFile, &index); err != nil {
+		return nil, fmt.Errorf("neither manifest.json nor a readable OCI index found: %w", err)
+	}
+	desc, err := selectImage(index.Manifests, "")
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := resolveManifest(layout, desc, platforms.Default())
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(manifest.Layers))
+	for _, layer := range manifest.Layers {
+		names = append(names, blobPath(layer.Digest))
+	}
+	return names, nil
+}
+
+// layerOpener opens the possibly compressed layer file name of the image layout
+func layerOpener(layout fs.FS, name string) LayerOpener {
+	return func() (io.ReadCloser, error) {
+		file, err := layout.Open(name)
+		if err != nil {
+			return nil, err
+		}
+		reader, err := DecompressLayer(file)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+		return readCloser{Reader: reader, closers: []io.Closer{reader, file}}, nil
+	}
+}
+
+// readCloser closes every closer once the reader is done
+type readCloser struct {
+	io.Reader
+	closers []io.Closer
+}
+
+func (r readCloser) Close() error {
+	var err error
+	for _, closer := range r.closers {
+		if closeErr := closer.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// FlattenLayers merges the layers, lowest first, into a single tar written to w.
+// The layers are read twice, once to find the surviving entries and once to copy them.
+func FlattenLayers(ctx context.Context, layers []LayerOpener, w io.Writer) error {
+	plan, err := planLayers(ctx, layers)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	emittedDirs := map[string]bool{}
+	for index, open := range layers {
+		if err := copyLayer(ctx, index, open, plan, emittedDirs, tw); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func planLayers(ctx context.Context, layers []LayerOpener) (*layerPlan, error) {
+	plan := &layerPlan{
+		owner:       map[string]int{},
+		dirs:        map[string]*tar.Header{},
+		materialize: make([]map[string][]string, len(layers)),
+	}
+	candidates := make([][]hardlink, len(layers))
+	for index, open := range layers {
+		var removed []string
+		var opaque []string
+		err := walkLayer(ctx, open, func(hdr *tar.Header, _ io.Reader) error {
+			name := CleanTarPath(hdr.Name)
+			base := path.Base(name)
+			switch {
+			case name == ".":
+				return nil
+			case base == whiteoutOpaque:
+				opaque = append(opaque, path.Dir(name))
+				return nil
+			case strings.HasPrefix(base, whiteoutPrefix):
+				removed = append(removed, path.Join(path.Dir(name), strings.TrimPrefix(base, whiteoutPrefix)))
+				return nil
+			}
+			if previous, ok := plan.owner[name]; ok && previous < index && hdr.Typeflag != tar.TypeDir {
+				// a file replacing a directory hides what the lower layers put below it
+				removed = append(removed, name+"/")
+			}
+			plan.owner[name] = index
+			if hdr.Typeflag == tar.TypeDir {
+				plan.dirs[name] = hdr
+			} else {
+				delete(plan.dirs, name)
+			}
+			if hdr.Typeflag == tar.TypeLink {
+				target := CleanTarPath(hdr.Linkname)
+				if plan.owns(index, target) {
+					candidates[index] = append(candidates[index], hardlink{name: name, target: target})
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		plan.applyWhiteouts(index, removed, opaque)
+	}
+	// hardlinks outliving their target carry the content of the target instead
+	for index, links := range candidates {
+		for _, link := range links {
+			if !plan.owns(index, link.name) || plan.owns(index, link.target) {
+				continue
+			}
+			if plan.materialize[index] == nil {
+				plan.materialize[index] = map[string][]string{}
+			}
+			plan.materialize[index][link.target] = append(plan.materialize[index][link.target], link.name)
+		}
+	}
+	return plan, nil
+}
+
+// owns reports whether the entry name of layer index survives
+func (p *layerPlan) owns(index int, name string) bool {
+	owner, ok := p.owner[name]
+	return ok && owner == index
+}
+
+// applyWhiteouts drops the entries provided below layer index which the layer removes,
+// paths ending in "/" only remove what is below them
+func (p *layerPlan) applyWhiteouts(index int, removed, opaque []string) {
+	if len(removed) == 0 && len(opaque) == 0 {
+		return
+	}
+	self := map[string]bool{}
+	below := map[string]bool{}
+	for _, name := range removed {
+		if strings.HasSuffix(name, "/") {
+			below[strings.TrimSuffix(name, "/")] = true
+			continue
+		}
+		self[name] = true
+		below[name] = true
+	}
+	for _, dir := range opaque {
+		below[dir] = true
+	}
+	for name, owner := range p.owner {
+		if owner >= index {
+			continue
+		}
+		drop := self[name]
+		for parent := path.Dir(name); !drop && parent != "."; parent = path.Dir(parent) {
+			drop = below[parent]
+		}
+		if drop || below["."] {
+			delete(p.owner, name)
+			delete(p.dirs, name)
+		}
+	}
+}
+
+func copyLayer(ctx context.Context, index int, open LayerOpener, plan *layerPlan, emittedDirs map[string]bool, tw *tar.Writer) error {
+	materialized := map[string]string{}
+	return walkLayer(ctx, open, func(hdr *tar.Header, body io.Reader) error {
+		name := CleanTarPath(hdr.Name)
+		if name == "." || strings.HasPrefix(path.Base(name), whiteoutPrefix) {
+			return nil
+		}
+		if dir, ok := plan.dirs[name]; ok {
+			// directories are written once, where they first appear, with the topmost header
+			if emittedDirs[name] {
+				return nil
+			}
+			emittedDirs[name] = true
+			return writeEntry(tw, dir, name, nil)
+		}
+		if !plan.owns(index, name) {
+			links := plan.materialize[index][name]
+			if len(links) == 0 || hdr.Typeflag != tar.TypeReg {
+				return nil
+			}
+			materialized[name] = links[0]
+			return writeEntry(tw, hdr, links[0], body)
+		}
+		if hdr.Typeflag == tar.TypeLink {
+			target := CleanTarPath(hdr.Linkname)
+			if replacement, ok := materialized[target]; ok {
+				if replacement == name {
+					return nil
+				}
+				target = replacement
+			} else if owner, ok := plan.owner[target]; !ok || owner > index {
+				logrus.Warnf("hardlink %s points to %s which is replaced or removed, skipping", name, target)
+				return nil
+			}
+			link := *hdr
+			link.Linkname = target
+			return writeEntry(tw, &link, name, nil)
+		}
+		return writeEntry(tw, hdr, name, body)
+	})
+}
+
+// writeEntry writes hdr under name, body is copied for regular files
+func writeEntry(tw *tar.Writer, hdr *tar.Header, name string, body io.Reader) error {
+	entry := *hdr
+	entry.Name = name
+	if entry.Typeflag == tar.TypeDir {
+		entry.Name += "/"
+	}
+	if entry.PAXRecords != nil {
+		records := map[string]string{}
+		for key, value := range entry.PAXRecords {
+			if key != "path" && key != "linkpath" {
+				records[key] = value
+			}
+		}
+		entry.PAXRecords = records
+	}
+	if entry.Typeflag != tar.TypeReg {
+		entry.Size = 0
+	}
+	if err := tw.WriteHeader(&entry); err != nil {
+		return err
+	}
+	if entry.Typeflag == tar.TypeReg && body != nil {
+		if _, err := io.Copy(tw, body); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// walkLayer calls fn with every entry of the layer, stopping when ctx is cancelled
+func walkLayer(ctx context.Context, open LayerOpener, fn func(hdr *tar.Header, body io.Reader) error) error {
+	reader, err := open()
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	tr := tar.NewReader(reader)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,182 @@
+package utils
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"io"
+	"reflect"
+	"testing"
+)
+
+// layerOf serves the tar built from entries as a layer
+func layerOf(t *testing.T, entries []testEntry) LayerOpener {
+	archive := buildTar(t, entries)
+	return func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(archive)), nil
+	}
+}
+
+// readEntries summarizes a tar as name to "dir", "file:<body>", "symlink:<target>" or "link:<target>"
+func readEntries(t *testing.T, r io.Reader) map[string]string {
+	t.Helper()
+	entries := map[string]string{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		name := CleanTarPath(hdr.Name)
+		if _, ok := entries[name]; ok {
+			t.Fatalf("%s written twice", name)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			entries[name] = "dir"
+		case tar.TypeReg:
+			body, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries[name] = "file:" + string(body)
+		case tar.TypeSymlink:
+			entries[name] = "symlink:" + hdr.Linkname
+		case tar.TypeLink:
+			entries[name] = "link:" + CleanTarPath(hdr.Linkname)
+		}
+	}
+}
+
+func tarFile(name, body string) testEntry {
+	return testEntry{name: name, typeflag: tar.TypeReg, body: body}
+}
+
+func tarDir(name string) testEntry {
+	return testEntry{name: name, typeflag: tar.TypeDir}
+}
+
+func TestFlattenLayers(t *testing.T) {
+	tests := []struct {
+		name   string
+		layers [][]testEntry
+		want   map[string]string
+	}{
+		{
+			name: "whiteout file",
+			layers: [][]testEntry{
+				{tarDir("a"), tarFile("a/x", "x"), tarFile("a/y", "y")},
+				{tarDir("a"), tarFile("a/.wh.x", "")},
+			},
+			want: map[string]string{"a": "dir", "a/y": "file:y"},
+		},
+		{
+			name: "whiteout directory",
+			layers: [][]testEntry{
+				{tarDir("d"), tarFile("d/x", "x"), tarFile("keep", "k")},
+				{tarFile(".wh.d", "")},
+			},
+			want: map[string]string{"keep": "file:k"},
+		},
+		{
+			name: "whiteout then recreated",
+			layers: [][]testEntry{
+				{tarFile("a", "old")},
+				{tarFile(".wh.a", "")},
+				{tarFile("a", "new")},
+			},
+			want: map[string]string{"a": "file:new"},
+		},
+		{
+			name: "opaque directory",
+			layers: [][]testEntry{
+				{tarDir("a"), tarFile("a/x", "x"), tarDir("a/b"), tarFile("a/b/z", "z"), tarFile("other", "o")},
+				{tarDir("a"), tarFile("a/.wh..wh..opq", ""), tarFile("a/n", "n")},
+			},
+			want: map[string]string{"a": "dir", "a/n": "file:n", "other": "file:o"},
+		},
+		{
+			name: "directory replaced by file",
+			layers: [][]testEntry{
+				{tarDir("a"), tarFile("a/x", "x")},
+				{tarFile("a", "f")},
+			},
+			want: map[string]string{"a": "file:f"},
+		},
+		{
+			name: "file replaced by directory",
+			layers: [][]testEntry{
+				{tarFile("a", "f")},
+				{tarDir("a"), tarFile("a/x", "x")},
+			},
+			want: map[string]string{"a": "dir", "a/x": "file:x"},
+		},
+		{
+			name: "file replaced by symlink",
+			layers: [][]testEntry{
+				{tarFile("a", "f")},
+				{{name: "a", typeflag: tar.TypeSymlink, linkname: "b"}},
+			},
+			want: map[string]string{"a": "symlink:b"},
+		},
+		{
+			name: "hardlink kept",
+			layers: [][]testEntry{
+				{tarFile("t", "c"), {name: "h", typeflag: tar.TypeLink, linkname: "t"}},
+			},
+			want: map[string]string{"t": "file:c", "h": "link:t"},
+		},
+		{
+			name: "hardlink whose target is deleted",
+			layers: [][]testEntry{
+				{tarFile("t", "c"), {name: "h", typeflag: tar.TypeLink, linkname: "t"}},
+				{tarFile(".wh.t", "")},
+			},
+			want: map[string]string{"h": "file:c"},
+		},
+		{
+			name: "hardlinks whose target is deleted",
+			layers: [][]testEntry{
+				{tarFile("t", "c"), {name: "h1", typeflag: tar.TypeLink, linkname: "t"},
+					{name: "h2", typeflag: tar.TypeLink, linkname: "t"}},
+				{tarFile(".wh.t", "")},
+			},
+			want: map[string]string{"h1": "file:c", "h2": "link:h1"},
+		},
+		{
+			name: "hardlink whose target is replaced",
+			layers: [][]testEntry{
+				{tarFile("t", "old"), {name: "h", typeflag: tar.TypeLink, linkname: "t"}},
+				{tarFile("t", "new")},
+			},
+			want: map[string]string{"t": "file:new", "h": "file:old"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var layers []LayerOpener
+			for _, entries := range tt.layers {
+				layers = append(layers, layerOf(t, entries))
+			}
+			var buf bytes.Buffer
+			if err := FlattenLayers(context.Background(), layers, &buf); err != nil {
+				t.Fatal(err)
+			}
+			if got := readEntries(t, &buf); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFlattenLayersCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	layers := []LayerOpener{layerOf(t, []testEntry{tarFile("a", "a")})}
+	if err := FlattenLayers(ctx, layers, io.Discard); err == nil {
+		t.Fatal("cancelled flatten succeeded")
+	}
+}
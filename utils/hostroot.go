@@ -0,0 +1,61 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// HostRootEnv names the variable holding where the host filesystem is mounted,
+// like /fenced/mnt/host when vessel runs in a container
+const HostRootEnv = "VESSEL_HOST_ROOT"
+
+var hostRoot = filepath.Clean("/" + os.Getenv(HostRootEnv))
+
+// SetHostRoot sets where the host filesystem is mounted, "" or "/" when vessel runs on the host.
+// Sockets, snapshot and rootfs paths reported by the runtimes are resolved under it.
+func SetHostRoot(root string) {
+	hostRoot = filepath.Clean("/" + root)
+}
+
+// HostRoot returns where the host filesystem is mounted, "/" when vessel runs on the host
+func HostRoot() string {
+	return hostRoot
+}
+
+// HostPath resolves the absolute host path under the host root, relative paths are left alone
+func HostPath(path string) string {
+	if hostRoot == "/" || !filepath.IsAbs(path) || path == hostRoot || strings.HasPrefix(path, hostRoot+"/") {
+		return path
+	}
+	return filepath.Join(hostRoot, path)
+}
+
+// HostEndpoint resolves the socket of a unix:// endpoint under the host root, other endpoints are left alone
+func HostEndpoint(endpoint string) string {
+	path, ok := strings.CutPrefix(endpoint, "unix://")
+	if !ok {
+		return endpoint
+	}
+	return "unix://" + HostPath(path)
+}
+
+// HostMountOptions resolves the directories of overlay mount options under the host root
+func HostMountOptions(options []string) []string {
+	resolved := make([]string, 0, len(options))
+	for _, option := range options {
+		key, value, ok := strings.Cut(option, "=")
+		switch {
+		case ok && key == "lowerdir":
+			dirs := strings.Split(value, ":")
+			for i, dir := range dirs {
+				dirs[i] = HostPath(dir)
+			}
+			option = key + "=" + strings.Join(dirs, ":")
+		case ok && (key == "upperdir" || key == "workdir"):
+			option = key + "=" + HostPath(value)
+		}
+		resolved = append(resolved, option)
+	}
+	return resolved
+}
@@ -0,0 +1,71 @@
+package utils
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestHostPath(t *testing.T) {
+	defer SetHostRoot(HostRoot())
+	tests := []struct {
+		root string
+		path string
+		want string
+	}{
+		{"", "/run/containerd/containerd.sock", "/run/containerd/containerd.sock"},
+		{"/", "/run/containerd/containerd.sock", "/run/containerd/containerd.sock"},
+		{"/host", "/run/containerd/containerd.sock", "/host/run/containerd/containerd.sock"},
+		{"/host/", "/var/lib/docker", "/host/var/lib/docker"},
+		{"/host", "/host/var/lib/docker", "/host/var/lib/docker"},
+		{"/host", "/host", "/host"},
+		{"/host", "/hostname", "/host/hostname"},
+		{"/host", "relative/path", "relative/path"},
+	}
+	for _, tt := range tests {
+		SetHostRoot(tt.root)
+		if got := HostPath(tt.path); got != tt.want {
+			t.Errorf("HostPath(%q) under %q = %q, want %q", tt.path, tt.root, got, tt.want)
+		}
+	}
+	SetHostRoot("/host")
+	if got := HostEndpoint("unix:///run/crio/crio.sock"); got != "unix:///host/run/crio/crio.sock" {
+		t.Errorf("HostEndpoint = %q", got)
+	}
+	if got := HostEndpoint("tcp://10.0.0.1:2376"); got != "tcp://10.0.0.1:2376" {
+		t.Errorf("HostEndpoint of a tcp endpoint = %q", got)
+	}
+}
+
+func TestEndpointExpand(t *testing.T) {
+	defer SetHostRoot(HostRoot())
+	root := t.TempDir()
+	for _, socket := range []string{"run/user/1000/docker.sock", "run/user/1001/docker.sock"} {
+		if err := os.MkdirAll(filepath.Join(root, filepath.Dir(socket)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(root, socket), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	SetHostRoot(root)
+	t.Setenv("VESSEL_TEST_SOCKET", "/run/test.sock")
+	tests := []struct {
+		uri  string
+		want []string
+	}{
+		{"unix:///run/user/*/docker.sock", []string{"unix://" + root + "/run/user/1000/docker.sock", "unix://" + root + "/run/user/1001/docker.sock"}},
+		{"unix:///home/*/.docker/run/docker.sock", []string{}},
+		{"unix:///run/containerd/containerd.sock", []string{"unix://" + root + "/run/containerd/containerd.sock"}},
+		// variables come from the environment of vessel and are not resolved under the host root
+		{"unix://$VESSEL_TEST_SOCKET", []string{"unix:///run/test.sock"}},
+		{"$VESSEL_TEST_UNSET", nil},
+		{"tcp://127.0.0.1:2375", []string{"tcp://127.0.0.1:2375"}},
+	}
+	for _, tt := range tests {
+		if got := (Endpoint{URI: tt.uri}).Expand(); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("Expand(%q) = %q, want %q", tt.uri, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package utils
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// DockerArchiveManifest is an entry of the manifest.json of a docker-archive
+type DockerArchiveManifest struct {
+	Config   string
+	RepoTags []string
+	Layers   []string
+}
+
+// ImageTar gives random access to the entries of a saved image tarball, it implements fs.FS
+type ImageTar struct {
+	file    *os.File
+	entries map[string]*io.SectionReader
+	links   map[string]string
+}
+
+// OpenImageTar indexes the entries of the image tarball at imageTarPath
+func OpenImageTar(imageTarPath string) (*ImageTar, error) {
+	file, err := os.Open(imageTarPath)
+	if err != nil {
+		return nil, err
+	}
+	img := &ImageTar{
+		file:    file,
+		entries: map[string]*io.SectionReader{},
+		links:   map[string]string{},
+	}
+	// the reader seeks over file bodies, so the file offset after Next is where the body starts
+	tr := tar.NewReader(file)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("read image tar %s: %w", imageTarPath, err)
+		}
+		name := CleanTarPath(hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			offset, err := file.Seek(0, io.SeekCurrent)
+			if err != nil {
+				file.Close()
+				return nil, err
+			}
+			img.entries[name] = io.NewSectionReader(file, offset, hdr.Size)
+		case tar.TypeSymlink:
+			img.links[name] = CleanTarPath(path.Join(path.Dir(name), hdr.Linkname))
+		case tar.TypeLink:
+			img.links[name] = CleanTarPath(hdr.Linkname)
+		}
+	}
+	return img, nil
+}
+
+// Close releases the underlying file
+func (i *ImageTar) Close() error {
+	return i.file.Close()
+}
+
+// Open returns the file name of the tarball, links inside the tarball are followed
+func (i *ImageTar) Open(name string) (fs.File, error) {
+	section, err := i.section(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrNotExist}
+	}
+	return &imageTarFile{
+		SectionReader: io.NewSectionReader(section, 0, section.Size()),
+		name:          path.Base(name),
+	}, nil
+}
+
+// imageTarFile is a regular file of an ImageTar
+type imageTarFile struct {
+	*io.SectionReader
+	name string
+}
+
+func (f *imageTarFile) Stat() (fs.FileInfo, error) { return f, nil }
+func (f *imageTarFile) Close() error               { return nil }
+func (f *imageTarFile) Name() string               { return f.name }
+func (f *imageTarFile) Mode() fs.FileMode          { return 0444 }
+func (f *imageTarFile) ModTime() time.Time         { return time.Time{} }
+func (f *imageTarFile) IsDir() bool                { return false }
+func (f *imageTarFile) Sys() interface{}           { return nil }
+
+func (i *ImageTar) section(name string) (*io.SectionReader, error) {
+	name = CleanTarPath(name)
+	for hops := 0; hops < 16; hops++ {
+		if section, ok := i.entries[name]; ok {
+			return section, nil
+		}
+		target, ok := i.links[name]
+		if !ok {
+			break
+		}
+		name = target
+	}
+	return nil, os.ErrNotExist
+}
+
+// ReadJSON decodes the file name of the image layout into v
+func ReadJSON(layout fs.FS, name string, v interface{}) error {
+	data, err := fs.ReadFile(layout, name)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// ReadDockerManifest returns the first image of the docker-archive manifest.json
+func ReadDockerManifest(layout fs.FS) (*DockerArchiveManifest, error) {
+	var manifests []DockerArchiveManifest
+	if err := ReadJSON(layout, "manifest.json", &manifests); err != nil {
+		return nil, err
+	}
+	if len(manifests) == 0 {
+		return nil, errors.New("manifest.json lists no image")
+	}
+	return &manifests[0], nil
+}
+
+// DecompressLayer detects gzip and zstd compressed layers and returns the plain tar stream
+func DecompressLayer(reader io.Reader) (io.ReadCloser, error) {
+	buffered := bufio.NewReader(reader)
+	magic, err := buffered.Peek(4)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		return gzip.NewReader(buffered)
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		decoder, err := zstd.NewReader(buffered)
+		if err != nil {
+			return nil, err
+		}
+		return decoder.IOReadCloser(), nil
+	}
+	return io.NopCloser(buffered), nil
+}
+
+// CleanTarPath normalizes tar entry names to slash separated relative paths, "." for the root
+func CleanTarPath(name string) string {
+	cleaned := path.Clean("/" + name)
+	if cleaned == "/" {
+		return "."
+	}
+	return cleaned[1:]
+}
@@ -0,0 +1,399 @@
+package utils
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/containerd/platforms"
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+const (
+	dockerManifestListMediaType = "application/vnd.docker.distribution.manifest.list.v2+json"
+	dockerManifestMediaType     = "application/vnd.docker.distribution.manifest.v2+json"
+	containerdImageNameLabel    = "io.containerd.image.name"
+)
+
+// ConvertOptions selects the image converted out of an image layout
+type ConvertOptions struct {
+	// Platform picks the manifest of multi-arch indexes, the host platform when nil
+	Platform *ocispec.Platform
+	// Reference picks the image of the OCI index by name annotation, the first image when empty
+	Reference string
+	// RepoTags are recorded in the docker-archive, the OCI name annotations are used when empty
+	RepoTags []string
+}
+
+// OpenImageLayout opens an image layout which is either an extracted directory or a tarball
+func OpenImageLayout(src string) (fs.FS, io.Closer, error) {
+	info, err := os.Stat(src)
+	if err != nil {
+		return nil, nil, err
+	}
+	if info.IsDir() {
+		return os.DirFS(src), nopCloser{}, nil
+	}
+	img, err := OpenImageTar(src)
+	if err != nil {
+		return nil, nil, err
+	}
+	return img, img, nil
+}
+
+type nopCloser struct{}
+
+func (nopCloser) Close() error { return nil }
+
+// ConvertOCIToDockerArchive reads the OCI image layout at src, a directory or a tarball,
+// and writes the selected image as a docker-archive to w
+func ConvertOCIToDockerArchive(ctx context.Context, src string, w io.Writer, opts ConvertOptions) error {
+	layout, closer, err := OpenImageLayout(src)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	return convertOCIToDockerArchive(ctx, layout, w, opts)
+}
+
+func convertOCIToDockerArchive(ctx context.Context, layout fs.FS, w io.Writer, opts ConvertOptions) error {
+	var index ocispec.Index
+	if err := ReadJSON(layout, ocispec.ImageIndexFile, &index); err != nil {
+		return fmt.Errorf("read OCI index: %w", err)
+	}
+	desc, err := selectImage(index.Manifests, opts.Reference)
+	if err != nil {
+		return err
+	}
+	repoTags := opts.RepoTags
+	if len(repoTags) == 0 {
+		repoTags = imageNames(desc)
+	}
+	matcher := platforms.Default()
+	if opts.Platform != nil {
+		matcher = platforms.Only(*opts.Platform)
+	}
+	manifest, err := resolveManifest(layout, desc, matcher)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	configName := manifest.Config.Digest.Encoded() + ".json"
+	if err := copyBlob(tw, layout, manifest.Config.Digest, configName); err != nil {
+		return fmt.Errorf("write image config: %w", err)
+	}
+	var config ocispec.Image
+	if err := ReadJSON(layout, blobPath(manifest.Config.Digest), &config); err != nil {
+		return fmt.Errorf("read image config: %w", err)
+	}
+	if len(config.RootFS.DiffIDs) != len(manifest.Layers) {
+		return fmt.Errorf("image config lists %d diff ids for %d layers", len(config.RootFS.DiffIDs), len(manifest.Layers))
+	}
+	written := map[string]bool{}
+	layers := make([]string, 0, len(manifest.Layers))
+	for i, layer := range manifest.Layers {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		name := config.RootFS.DiffIDs[i].Encoded() + ".tar"
+		layers = append(layers, name)
+		if written[name] {
+			continue
+		}
+		written[name] = true
+		if err := copyLayerBlob(tw, layout, layer.Digest, name); err != nil {
+			return fmt.Errorf("write layer %s: %w", layer.Digest, err)
+		}
+	}
+
+	manifests := []DockerArchiveManifest{{Config: configName, RepoTags: repoTags, Layers: layers}}
+	if err := writeJSON(tw, "manifest.json", manifests); err != nil {
+		return err
+	}
+	repositories := map[string]map[string]string{}
+	if len(layers) > 0 {
+		top := strings.TrimSuffix(layers[len(layers)-1], ".tar")
+		for _, repoTag := range repoTags {
+			separator := strings.LastIndex(repoTag, ":")
+			if separator <= strings.LastIndex(repoTag, "/") {
+				continue
+			}
+			repo, tag := repoTag[:separator], repoTag[separator+1:]
+			if repositories[repo] == nil {
+				repositories[repo] = map[string]string{}
+			}
+			repositories[repo][tag] = top
+		}
+	}
+	if err := writeJSON(tw, "repositories", repositories); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// ConvertDockerArchiveToOCI reads the docker-archive at src, a directory or a tarball,
+// and writes its first image as an OCI image layout tarball to w
+func ConvertDockerArchiveToOCI(ctx context.Context, src string, w io.Writer, opts ConvertOptions) error {
+	layout, closer, err := OpenImageLayout(src)
+	if err != nil {
+		return err
+	}
+	defer closer.Close()
+	return convertDockerArchiveToOCI(ctx, layout, w, opts)
+}
+
+func convertDockerArchiveToOCI(ctx context.Context, layout fs.FS, w io.Writer, opts ConvertOptions) error {
+	dockerManifest, err := ReadDockerManifest(layout)
+	if err != nil {
+		return fmt.Errorf("read docker manifest: %w", err)
+	}
+	configData, err := fs.ReadFile(layout, dockerManifest.Config)
+	if err != nil {
+		return fmt.Errorf("read image config: %w", err)
+	}
+	var config ocispec.Image
+	if err := json.Unmarshal(configData, &config); err != nil {
+		return fmt.Errorf("read image config: %w", err)
+	}
+
+	tw := tar.NewWriter(w)
+	if err := writeJSON(tw, ocispec.ImageLayoutFile, ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion}); err != nil {
+		return err
+	}
+	configDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageConfig,
+		Digest:    digest.FromBytes(configData),
+		Size:      int64(len(configData)),
+	}
+	if err := writeBytes(tw, blobPath(configDesc.Digest), configData); err != nil {
+		return err
+	}
+	manifest := ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    configDesc,
+	}
+	manifest.SchemaVersion = 2
+	written := map[digest.Digest]bool{}
+	for _, layer := range dockerManifest.Layers {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		desc, err := writeOCILayer(tw, layout, layer, written)
+		if err != nil {
+			return fmt.Errorf("write layer %s: %w", layer, err)
+		}
+		manifest.Layers = append(manifest.Layers, desc)
+	}
+	manifestData, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	manifestDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromBytes(manifestData),
+		Size:      int64(len(manifestData)),
+		Platform: &ocispec.Platform{
+			Architecture: config.Architecture,
+			OS:           config.OS,
+			Variant:      config.Variant,
+		},
+	}
+	if err := writeBytes(tw, blobPath(manifestDesc.Digest), manifestData); err != nil {
+		return err
+	}
+	repoTags := opts.RepoTags
+	if len(repoTags) == 0 {
+		repoTags = dockerManifest.RepoTags
+	}
+	index := ocispec.Index{MediaType: ocispec.MediaTypeImageIndex}
+	index.SchemaVersion = 2
+	if len(repoTags) == 0 {
+		index.Manifests = append(index.Manifests, manifestDesc)
+	}
+	for _, repoTag := range repoTags {
+		desc := manifestDesc
+		desc.Annotations = map[string]string{
+			containerdImageNameLabel:  repoTag,
+			ocispec.AnnotationRefName: repoTag,
+		}
+		index.Manifests = append(index.Manifests, desc)
+	}
+	if err := writeJSON(tw, ocispec.ImageIndexFile, index); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// writeOCILayer stores the uncompressed docker-archive layer as an OCI blob
+func writeOCILayer(tw *tar.Writer, layout fs.FS, name string, written map[digest.Digest]bool) (ocispec.Descriptor, error) {
+	hash := sha256.New()
+	size, err := readLayer(layout, name, hash)
+	if err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	desc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageLayer,
+		Digest:    digest.NewDigest(digest.SHA256, hash),
+		Size:      size,
+	}
+	if written[desc.Digest] {
+		return desc, nil
+	}
+	written[desc.Digest] = true
+	if err := tw.WriteHeader(blobHeader(blobPath(desc.Digest), size)); err != nil {
+		return ocispec.Descriptor{}, err
+	}
+	_, err = readLayer(layout, name, tw)
+	return desc, err
+}
+
+// selectImage picks the index entry named reference, or the first one
+func selectImage(manifests []ocispec.Descriptor, reference string) (ocispec.Descriptor, error) {
+	if len(manifests) == 0 {
+		return ocispec.Descriptor{}, errors.New("OCI index lists no image")
+	}
+	if reference == "" {
+		return manifests[0], nil
+	}
+	for _, desc := range manifests {
+		for _, name := range imageNames(desc) {
+			if name == reference || strings.HasSuffix(name, ":"+reference) {
+				return desc, nil
+			}
+		}
+	}
+	return ocispec.Descriptor{}, fmt.Errorf("image %s not found in OCI index", reference)
+}
+
+// imageNames returns the fully qualified names annotated on an index entry
+func imageNames(desc ocispec.Descriptor) []string {
+	if name := desc.Annotations[containerdImageNameLabel]; name != "" {
+		return []string{name}
+	}
+	// the ref name annotation may be a bare tag, which is no usable repo tag
+	if name := desc.Annotations[ocispec.AnnotationRefName]; strings.Contains(name, ":") {
+		return []string{name}
+	}
+	return nil
+}
+
+// resolveManifest walks nested indexes down to the image manifest for the platform
+func resolveManifest(layout fs.FS, desc ocispec.Descriptor, matcher platforms.MatchComparer) (*ocispec.Manifest, error) {
+	for depth := 0; depth < 8; depth++ {
+		switch desc.MediaType {
+		case ocispec.MediaTypeImageManifest, dockerManifestMediaType:
+			var manifest ocispec.Manifest
+			if err := ReadJSON(layout, blobPath(desc.Digest), &manifest); err != nil {
+				return nil, fmt.Errorf("read manifest %s: %w", desc.Digest, err)
+			}
+			return &manifest, nil
+		case ocispec.MediaTypeImageIndex, dockerManifestListMediaType:
+			var index ocispec.Index
+			if err := ReadJSON(layout, blobPath(desc.Digest), &index); err != nil {
+				return nil, fmt.Errorf("read index %s: %w", desc.Digest, err)
+			}
+			var best *ocispec.Descriptor
+			for i, candidate := range index.Manifests {
+				if candidate.Platform != nil && !matcher.Match(*candidate.Platform) {
+					continue
+				}
+				// the platform manifest has to be part of the layout, exports often skip other platforms
+				if _, err := fs.Stat(layout, blobPath(candidate.Digest)); err != nil {
+					continue
+				}
+				if best == nil || (candidate.Platform != nil && best.Platform != nil && matcher.Less(*candidate.Platform, *best.Platform)) {
+					best = &index.Manifests[i]
+				}
+			}
+			if best == nil {
+				return nil, fmt.Errorf("no manifest for the platform in index %s", desc.Digest)
+			}
+			desc = *best
+		default:
+			return nil, fmt.Errorf("unsupported media type %s of %s", desc.MediaType, desc.Digest)
+		}
+	}
+	return nil, errors.New("OCI index nested too deep")
+}
+
+// readLayer copies the decompressed layer file name into w and returns its size
+func readLayer(layout fs.FS, name string, w io.Writer) (int64, error) {
+	reader, err := layerOpener(layout, name)()
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+	return io.Copy(w, reader)
+}
+
+// copyLayerBlob writes the decompressed layer blob as the docker-archive file name,
+// the blob is read twice since the tar header needs the uncompressed size
+func copyLayerBlob(tw *tar.Writer, layout fs.FS, blob digest.Digest, name string) error {
+	size, err := readLayer(layout, blobPath(blob), io.Discard)
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(blobHeader(name, size)); err != nil {
+		return err
+	}
+	_, err = readLayer(layout, blobPath(blob), tw)
+	return err
+}
+
+// copyBlob writes the blob unchanged as the archive file name
+func copyBlob(tw *tar.Writer, layout fs.FS, blob digest.Digest, name string) error {
+	file, err := layout.Open(blobPath(blob))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(blobHeader(name, info.Size())); err != nil {
+		return err
+	}
+	_, err = io.Copy(tw, file)
+	return err
+}
+
+func writeJSON(tw *tar.Writer, name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return writeBytes(tw, name, data)
+}
+
+func writeBytes(tw *tar.Writer, name string, data []byte) error {
+	if err := tw.WriteHeader(blobHeader(name, int64(len(data)))); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+func blobHeader(name string, size int64) *tar.Header {
+	return &tar.Header{
+		Name:     name,
+		Typeflag: tar.TypeReg,
+		Mode:     0644,
+		Size:     size,
+	}
+}
+
+// blobPath is where an OCI image layout stores the blob
+func blobPath(blob digest.Digest) string {
+	return path.Join(ocispec.ImageBlobsDir, blob.Algorithm().String(), blob.Encoded())
+}
@@ -0,0 +1,201 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	digest "github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// writeLayoutFile writes data at name below the layout directory
+func writeLayoutFile(t *testing.T, layout, name string, data []byte) {
+	t.Helper()
+	target := filepath.Join(layout, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(target, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func marshal(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// writeBlob stores data as a blob of the OCI layout and describes it
+func writeBlob(t *testing.T, layout, mediaType string, data []byte) ocispec.Descriptor {
+	t.Helper()
+	desc := ocispec.Descriptor{MediaType: mediaType, Digest: digest.FromBytes(data), Size: int64(len(data))}
+	writeLayoutFile(t, layout, blobPath(desc.Digest), data)
+	return desc
+}
+
+// writeOCIImage stores an image of one layer for the platform and returns its manifest descriptor
+func writeOCIImage(t *testing.T, layout string, platform ocispec.Platform, layer []byte) ocispec.Descriptor {
+	t.Helper()
+	config := ocispec.Image{Platform: platform}
+	config.RootFS = ocispec.RootFS{Type: "layers", DiffIDs: []digest.Digest{digest.FromBytes(layer)}}
+	manifest := ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    writeBlob(t, layout, ocispec.MediaTypeImageConfig, marshal(t, config)),
+		Layers:    []ocispec.Descriptor{writeBlob(t, layout, ocispec.MediaTypeImageLayer, layer)},
+	}
+	manifest.SchemaVersion = 2
+	desc := writeBlob(t, layout, ocispec.MediaTypeImageManifest, marshal(t, manifest))
+	desc.Platform = &platform
+	return desc
+}
+
+// flattenArchive returns the entries of the root filesystem of the image archive
+func flattenArchive(t *testing.T, archive []byte) map[string]string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "image.tar")
+	if err := os.WriteFile(path, archive, 0644); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := FlattenImage(context.Background(), path, &buf); err != nil {
+		t.Fatal(err)
+	}
+	return readEntries(t, &buf)
+}
+
+func TestConvertRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	layer := buildTar(t, []testEntry{tarDir("etc"), tarFile("etc/hostname", "vessel")})
+	config := marshal(t, ocispec.Image{
+		Platform: ocispec.Platform{OS: "linux", Architecture: "amd64"},
+		RootFS:   ocispec.RootFS{Type: "layers", DiffIDs: []digest.Digest{digest.FromBytes(layer)}},
+	})
+	archive := t.TempDir()
+	writeLayoutFile(t, archive, "config.json", config)
+	writeLayoutFile(t, archive, "layer/layer.tar", layer)
+	writeLayoutFile(t, archive, "manifest.json", marshal(t, []DockerArchiveManifest{{
+		Config:   "config.json",
+		RepoTags: []string{"example.com/app:1"},
+		Layers:   []string{"layer/layer.tar"},
+	}}))
+
+	var oci bytes.Buffer
+	if err := ConvertDockerArchiveToOCI(ctx, archive, &oci, ConvertOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	ociPath := filepath.Join(t.TempDir(), "oci.tar")
+	if err := os.WriteFile(ociPath, oci.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	layout, err := OpenImageTar(ociPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer layout.Close()
+	var index ocispec.Index
+	if err := ReadJSON(layout, ocispec.ImageIndexFile, &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Manifests) != 1 || index.Manifests[0].Annotations[ocispec.AnnotationRefName] != "example.com/app:1" {
+		t.Fatalf("unexpected OCI index %+v", index.Manifests)
+	}
+	if platform := index.Manifests[0].Platform; platform == nil || platform.Architecture != "amd64" {
+		t.Fatalf("OCI index platform %+v", platform)
+	}
+
+	var docker bytes.Buffer
+	if err := ConvertOCIToDockerArchive(ctx, ociPath, &docker, ConvertOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	dockerPath := filepath.Join(t.TempDir(), "docker.tar")
+	if err := os.WriteFile(dockerPath, docker.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	converted, err := OpenImageTar(dockerPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer converted.Close()
+	manifest, err := ReadDockerManifest(converted)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(manifest.RepoTags, []string{"example.com/app:1"}) {
+		t.Fatalf("repo tags %v", manifest.RepoTags)
+	}
+	if data, err := fs.ReadFile(converted, manifest.Config); err != nil || !bytes.Equal(data, config) {
+		t.Fatalf("config changed by the round trip: %s %v", data, err)
+	}
+	if len(manifest.Layers) != 1 {
+		t.Fatalf("layers %v", manifest.Layers)
+	}
+	if data, err := fs.ReadFile(converted, manifest.Layers[0]); err != nil || !bytes.Equal(data, layer) {
+		t.Fatalf("layer changed by the round trip: %v", err)
+	}
+	want := map[string]string{"etc": "dir", "etc/hostname": "file:vessel"}
+	if got := flattenArchive(t, docker.Bytes()); !reflect.DeepEqual(got, want) {
+		t.Fatalf("flattened %v, want %v", got, want)
+	}
+}
+
+func TestConvertMultiPlatformIndex(t *testing.T) {
+	layout := t.TempDir()
+	amd64 := ocispec.Platform{OS: "linux", Architecture: "amd64"}
+	arm64 := ocispec.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}
+	s390x := ocispec.Platform{OS: "linux", Architecture: "s390x"}
+	manifests := []ocispec.Descriptor{
+		writeOCIImage(t, layout, amd64, buildTar(t, []testEntry{tarFile("arch", "amd64")})),
+		writeOCIImage(t, layout, arm64, buildTar(t, []testEntry{tarFile("arch", "arm64")})),
+	}
+	// exports often list platforms whose blobs they left out
+	missing := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    digest.FromString("not exported"),
+		Platform:  &s390x,
+	}
+	manifests = append(manifests, missing)
+	nested := ocispec.Index{MediaType: ocispec.MediaTypeImageIndex, Manifests: manifests}
+	nested.SchemaVersion = 2
+	indexDesc := writeBlob(t, layout, ocispec.MediaTypeImageIndex, marshal(t, nested))
+	indexDesc.Annotations = map[string]string{ocispec.AnnotationRefName: "example.com/multi:1"}
+	index := ocispec.Index{Manifests: []ocispec.Descriptor{indexDesc}}
+	index.SchemaVersion = 2
+	writeLayoutFile(t, layout, ocispec.ImageIndexFile, marshal(t, index))
+	writeLayoutFile(t, layout, ocispec.ImageLayoutFile, marshal(t, ocispec.ImageLayout{Version: ocispec.ImageLayoutVersion}))
+
+	for _, platform := range []ocispec.Platform{amd64, arm64} {
+		t.Run(platform.Architecture, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := ConvertOCIToDockerArchive(context.Background(), layout, &buf, ConvertOptions{Platform: &platform})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := map[string]string{"arch": "file:" + platform.Architecture}
+			if got := flattenArchive(t, buf.Bytes()); !reflect.DeepEqual(got, want) {
+				t.Fatalf("flattened %v, want %v", got, want)
+			}
+		})
+	}
+	t.Run("platform not exported", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := ConvertOCIToDockerArchive(context.Background(), layout, &buf, ConvertOptions{Platform: &s390x}); err == nil {
+			t.Fatal("converted a platform missing from the layout")
+		}
+	})
+	t.Run("unknown reference", func(t *testing.T) {
+		var buf bytes.Buffer
+		if err := ConvertOCIToDockerArchive(context.Background(), layout, &buf, ConvertOptions{Reference: "other:2"}); err == nil {
+			t.Fatal("converted an image missing from the index")
+		}
+	})
+}
@@ -0,0 +1,237 @@
+package utils
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// trustedOpaqueXattr marks the opaque directories of rootful overlays, only readable with CAP_SYS_ADMIN
+	trustedOpaqueXattr = "trusted.overlay.opaque"
+	// userOpaqueXattr marks the opaque directories of overlays mounted with userxattr, like rootless ones
+	userOpaqueXattr = "user.overlay.opaque"
+)
+
+// ErrOpaqueUnreadable is returned by TarOverlay, before anything is written, when the opaque marks of
+// a rootful overlay can not be read: the directories recreated in an upper layer would show the entries
+// the lower layers had. The overlay has to be mounted instead.
+var ErrOpaqueUnreadable = fmt.Errorf("%s needs CAP_SYS_ADMIN to be read: %w", trustedOpaqueXattr, os.ErrPermission)
+
+// hasCapSysAdmin tells whether the process can read trusted xattrs, without it they read as missing
+var hasCapSysAdmin = func() bool {
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&hdr, &data[0]); err != nil {
+		return false
+	}
+	return data[0].Effective&(1<<unix.CAP_SYS_ADMIN) != 0
+}
+
+// Overlay is the stack of directories an overlay or a bind mount shows
+type Overlay struct {
+	// Layers are ordered topmost first: the upperdir then the lowerdirs
+	Layers []string
+	// UserXattr tells the opaque directories are marked with user xattrs rather than trusted ones
+	UserXattr bool
+}
+
+// OverlayMount returns the directories an overlay or a bind mount shows, resolved under the host root.
+// ok is false for the other mounts, they can not be read without mounting them.
+func OverlayMount(mountType, source string, options []string) (overlay Overlay, ok bool) {
+	switch mountType {
+	case "bind", "rbind":
+		return Overlay{Layers: []string{HostPath(source)}}, true
+	case "overlay":
+	default:
+		return Overlay{}, false
+	}
+	var upper string
+	var lower []string
+	for _, option := range options {
+		key, value, _ := strings.Cut(option, "=")
+		switch key {
+		case "upperdir":
+			upper = value
+		case "lowerdir":
+			lower = strings.Split(value, ":")
+		case "userxattr":
+			overlay.UserXattr = true
+		}
+	}
+	if upper != "" {
+		overlay.Layers = append(overlay.Layers, HostPath(upper))
+	}
+	for _, dir := range lower {
+		overlay.Layers = append(overlay.Layers, HostPath(dir))
+	}
+	return overlay, len(overlay.Layers) > 0
+}
+
+// opaqueXattr is the xattr marking the opaque directories of the overlay
+func (o Overlay) opaqueXattr() string {
+	if o.UserXattr {
+		return userOpaqueXattr
+	}
+	return trustedOpaqueXattr
+}
+
+// TarOverlay writes to w the tree the overlay would show, without mounting it.
+// The whiteouts, character devices 0/0, hide the entries of the layers below them and the opaque
+// directories the directories below them. Entries are written like TarDirectory writes them.
+func TarOverlay(ctx context.Context, overlay Overlay, w io.Writer) error {
+	layers := overlay.Layers
+	if len(layers) == 0 {
+		return errors.New("no overlay layers to archive")
+	}
+	if len(layers) > 1 && !overlay.UserXattr && !hasCapSysAdmin() {
+		return ErrOpaqueUnreadable
+	}
+	root, err := os.Lstat(layers[0])
+	if err != nil {
+		return err
+	}
+	t := &overlayTar{tarWriter: newTarWriter(w), xattr: overlay.opaqueXattr()}
+	if err := t.add(layers[0], ".", root); err != nil {
+		return err
+	}
+	dirs := []string{layers[0]}
+	for _, layer := range layers[1:] {
+		opaque, err := t.isOpaque(dirs[len(dirs)-1])
+		if err != nil {
+			return err
+		}
+		if opaque {
+			break
+		}
+		dirs = append(dirs, layer)
+	}
+	if err := t.dir(ctx, ".", dirs); err != nil {
+		return err
+	}
+	return t.close()
+}
+
+// overlayTar merges the directories of the layers into a tar
+type overlayTar struct {
+	*tarWriter
+	xattr string
+}
+
+// overlayEntry is an entry of a merged directory, dirs are the directories it merges when it is one
+type overlayEntry struct {
+	path string
+	info fs.FileInfo
+	dirs []string
+	// merged is set once a lower layer can not add to the directory anymore
+	merged bool
+}
+
+// dir writes the entries of the directory rel merged from dirs, topmost first, then recurses
+func (t *overlayTar) dir(ctx context.Context, rel string, dirs []string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	entries := map[string]*overlayEntry{}
+	hidden := map[string]bool{}
+	var names []string
+	for _, dir := range dirs {
+		dirEntries, err := os.ReadDir(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		for _, dirEntry := range dirEntries {
+			name := dirEntry.Name()
+			if hidden[name] {
+				continue
+			}
+			path := filepath.Join(dir, name)
+			info, err := dirEntry.Info()
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			entry, ok := entries[name]
+			if !ok {
+				if isWhiteout(info) {
+					hidden[name] = true
+					continue
+				}
+				entry = &overlayEntry{path: path, info: info}
+				if info.IsDir() {
+					entry.dirs = []string{path}
+				}
+				entries[name] = entry
+				names = append(names, name)
+				continue
+			}
+			// a directory merges the directories below it up to an opaque one, anything else hides them
+			if entry.merged || !entry.info.IsDir() || !info.IsDir() {
+				entry.merged = true
+				continue
+			}
+			opaque, err := t.isOpaque(entry.dirs[len(entry.dirs)-1])
+			if err != nil {
+				return err
+			}
+			if opaque {
+				entry.merged = true
+				continue
+			}
+			entry.dirs = append(entry.dirs, path)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		entry := entries[name]
+		entryRel := filepath.Join(rel, name)
+		if err := t.add(entry.path, entryRel, entry.info); err != nil {
+			return err
+		}
+		if entry.info.IsDir() {
+			if err := t.dir(ctx, entryRel, entry.dirs); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// isOpaque tells whether the directory hides the directories of the lower layers,
+// an xattr which can not be read fails rather than leaving lower entries visible
+func (t *overlayTar) isOpaque(dir string) (bool, error) {
+	value := make([]byte, 1)
+	n, err := unix.Lgetxattr(dir, t.xattr, value)
+	switch {
+	case err == nil:
+		return n == 1 && value[0] == 'y', nil
+	case slices.Contains([]error{unix.ENODATA, unix.ENOTSUP, unix.ERANGE}, err):
+		// ERANGE is a value longer than "y"
+		return false, nil
+	}
+	return false, &fs.PathError{Op: "getxattr " + t.xattr, Path: dir, Err: err}
+}
+
+// isWhiteout tells whether the entry is an overlay whiteout, a character device numbered 0/0
+func isWhiteout(info fs.FileInfo) bool {
+	if info.Mode()&fs.ModeCharDevice == 0 {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && stat.Rdev == 0
+}
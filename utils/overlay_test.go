@@ -0,0 +1,140 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+// layerTree creates the files of a layer, names ending in "/" are directories
+func layerTree(t *testing.T, root string, files map[string]string) {
+	t.Helper()
+	for name, body := range files {
+		target := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if filepath.Clean(name) != name {
+			if err := os.MkdirAll(target, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if err := os.WriteFile(target, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// whiteout creates the character device 0/0 overlay uses to delete name
+func whiteout(t *testing.T, name string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.Mknod(name, unix.S_IFCHR, 0); err != nil {
+		t.Skipf("whiteouts can not be created: %v", err)
+	}
+}
+
+// markOpaque sets the opaque xattr on dir
+func markOpaque(t *testing.T, dir, attr string) {
+	t.Helper()
+	if err := unix.Lsetxattr(dir, attr, []byte("y"), 0); err != nil {
+		t.Skipf("%s can not be set: %v", attr, err)
+	}
+}
+
+// testOverlay builds three layers, topmost first, whose upper one deletes and recreates entries
+func testOverlay(t *testing.T, attr string) []string {
+	root := t.TempDir()
+	upper, middle, lower := filepath.Join(root, "upper"), filepath.Join(root, "middle"), filepath.Join(root, "lower")
+	layerTree(t, lower, map[string]string{
+		"a/x": "lower x", "a/y": "lower y", "b/z": "z", "c": "c", "o/old": "old", "keep": "k",
+	})
+	layerTree(t, middle, map[string]string{"a/x": "middle x", "d": "d"})
+	layerTree(t, upper, map[string]string{"o/new": "new", "a/": ""})
+	whiteout(t, filepath.Join(upper, "c"))
+	whiteout(t, filepath.Join(middle, "b"))
+	whiteout(t, filepath.Join(upper, "a/y"))
+	markOpaque(t, filepath.Join(upper, "o"), attr)
+	return []string{upper, middle, lower}
+}
+
+func TestTarOverlay(t *testing.T) {
+	want := map[string]string{
+		"":      "dir",
+		"a":     "dir",
+		"a/x":   "file:middle x",
+		"d":     "file:d",
+		"keep":  "file:k",
+		"o":     "dir",
+		"o/new": "file:new",
+	}
+	tests := []struct {
+		name    string
+		overlay func(layers []string) Overlay
+		attr    string
+	}{
+		{"trusted xattr", func(layers []string) Overlay { return Overlay{Layers: layers} }, trustedOpaqueXattr},
+		{"user xattr", func(layers []string) Overlay { return Overlay{Layers: layers, UserXattr: true} }, userOpaqueXattr},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.attr == trustedOpaqueXattr && !hasCapSysAdmin() {
+				t.Skip("trusted xattrs need CAP_SYS_ADMIN")
+			}
+			overlay := tt.overlay(testOverlay(t, tt.attr))
+			var buf bytes.Buffer
+			if err := TarOverlay(context.Background(), overlay, &buf); err != nil {
+				t.Fatal(err)
+			}
+			got := readEntries(t, &buf)
+			got[""] = got["."]
+			delete(got, ".")
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("got %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestTarOverlayOpaqueUnreadable(t *testing.T) {
+	defer func(f func() bool) { hasCapSysAdmin = f }(hasCapSysAdmin)
+	hasCapSysAdmin = func() bool { return false }
+	root := t.TempDir()
+	layerTree(t, root, map[string]string{"upper/f": "f", "lower/g": "g"})
+	var buf bytes.Buffer
+	overlay := Overlay{Layers: []string{filepath.Join(root, "upper"), filepath.Join(root, "lower")}}
+	if err := TarOverlay(context.Background(), overlay, &buf); !errors.Is(err, ErrOpaqueUnreadable) {
+		t.Fatalf("got %v, want ErrOpaqueUnreadable", err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("%d bytes written before failing", buf.Len())
+	}
+	// a bind mount has no lower layer to hide
+	bind := Overlay{Layers: []string{filepath.Join(root, "upper")}}
+	if err := TarOverlay(context.Background(), bind, &buf); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOverlayMount(t *testing.T) {
+	overlay, ok := OverlayMount("overlay", "overlay", []string{"index=off", "workdir=/w", "upperdir=/u", "lowerdir=/l1:/l2", "userxattr"})
+	want := Overlay{Layers: []string{"/u", "/l1", "/l2"}, UserXattr: true}
+	if !ok || !reflect.DeepEqual(overlay, want) {
+		t.Fatalf("got %+v %v, want %+v", overlay, ok, want)
+	}
+	if overlay, ok := OverlayMount("bind", "/snapshots/1/fs", []string{"ro", "rbind"}); !ok || !reflect.DeepEqual(overlay.Layers, []string{"/snapshots/1/fs"}) {
+		t.Fatalf("bind mount read as %+v %v", overlay, ok)
+	}
+	if _, ok := OverlayMount("ext4", "/dev/mapper/snap", nil); ok {
+		t.Fatal("block device mount read as an overlay")
+	}
+}
@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// DockerCertPathEnv follows the docker CLI
+	DockerCertPathEnv = "DOCKER_CERT_PATH"
+	SSHProtocol       = "ssh"
+)
+
+// TLSConfig locates the client certificates for a docker or podman daemon listening on tcp://
+type TLSConfig struct {
+	CAFile   string
+	CertFile string
+	KeyFile  string
+	// Insecure skips the verification of the daemon certificate, which is otherwise checked
+	// against CAFile, or the system pool when CAFile is empty. Podman does not support it.
+	Insecure bool
+}
+
+// TLSFromCertPath uses the ca.pem, cert.pem and key.pem of dir, the layout of DOCKER_CERT_PATH
+func TLSFromCertPath(dir string) *TLSConfig {
+	return &TLSConfig{
+		CAFile:   filepath.Join(dir, "ca.pem"),
+		CertFile: filepath.Join(dir, "cert.pem"),
+		KeyFile:  filepath.Join(dir, "key.pem"),
+	}
+}
+
+// TLSFromEnv reads DOCKER_CERT_PATH, nil when it is unset. Unlike the docker CLI without DOCKER_TLS_VERIFY,
+// the certificate of the daemon is verified.
+func TLSFromEnv() *TLSConfig {
+	dir := os.Getenv(DockerCertPathEnv)
+	if dir == "" {
+		return nil
+	}
+	return TLSFromCertPath(dir)
+}
+
+// ClientConfig loads the certificates into a client tls config
+func (t *TLSConfig) ClientConfig() (*tls.Config, error) {
+	config := &tls.Config{InsecureSkipVerify: t.Insecure}
+	if t.CAFile != "" {
+		ca, err := os.ReadFile(t.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificate found in %s", t.CAFile)
+		}
+	}
+	if t.CertFile != "" || t.KeyFile != "" {
+		pair, err := tls.LoadX509KeyPair(t.CertFile, t.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{pair}
+	}
+	return config, nil
+}
+
+// IsTCPEndpoint tells whether the endpoint is a tcp:// one
+func IsTCPEndpoint(endpoint string) bool {
+	return strings.HasPrefix(endpoint, TCPProtocol+"://")
+}
+
+// IsSSHEndpoint tells whether the endpoint is a ssh:// one, only podman can use them
+func IsSSHEndpoint(endpoint string) bool {
+	return strings.HasPrefix(endpoint, SSHProtocol+"://")
+}
+
+// PodmanRemoteArgs returns the podman global flags to reach the service at endpoint,
+// the tls flags are only passed for tcp:// endpoints and the identity for ssh:// ones
+func PodmanRemoteArgs(endpoint string, tlsConfig *TLSConfig, identity string) []string {
+	args := []string{"--remote", "--url", endpoint}
+	if IsSSHEndpoint(endpoint) && identity != "" {
+		args = append(args, "--identity", identity)
+	}
+	if IsTCPEndpoint(endpoint) && tlsConfig != nil {
+		if tlsConfig.CAFile != "" {
+			args = append(args, "--tls-ca", tlsConfig.CAFile)
+		}
+		if tlsConfig.CertFile != "" {
+			args = append(args, "--tls-cert", tlsConfig.CertFile)
+		}
+		if tlsConfig.KeyFile != "" {
+			args = append(args, "--tls-key", tlsConfig.KeyFile)
+		}
+	}
+	return args
+}
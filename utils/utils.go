@@ -4,12 +4,14 @@ import (
 	"archive/tar"
 	"bytes"
 	"compress/gzip"
-	"errors"
+	"context"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
+	"strings"
 
+	"github.com/deepfence/vessel/errdefs"
 	"github.com/sirupsen/logrus"
 )
 
@@ -59,11 +61,92 @@ func RunCommand(cmd *exec.Cmd, operation string) (*bytes.Buffer, error) {
 	var stderr bytes.Buffer
 	cmd.Stdout = &out
 	cmd.Stderr = &stderr
+	if err := errdefs.CommandError(cmd); err != nil {
+		return nil, err
+	}
 	errorOnRun := cmd.Run()
 	if errorOnRun != nil {
 		logrus.Errorf("cmd: %s", cmd.String())
 		logrus.Error(errorOnRun)
-		return nil, errors.New(operation + fmt.Sprint(errorOnRun) + ": " + stderr.String())
+		return nil, fmt.Errorf("%s%w: %s", operation, errorOnRun, stderr.String())
 	}
 	return &out, nil
 }
+
+// RunCommandTo streams the output of cmd to w, operation is prepended to error message in case of error: optional
+func RunCommandTo(cmd *exec.Cmd, w io.Writer, operation string) error {
+	var stderr bytes.Buffer
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+	if err := errdefs.CommandError(cmd); err != nil {
+		return err
+	}
+	if err := cmd.Run(); err != nil {
+		logrus.Errorf("cmd: %s", cmd.String())
+		logrus.Error(err)
+		return fmt.Errorf("%s%w: %s", operation, err, stderr.String())
+	}
+	return nil
+}
+
+// StreamFunc runs write in the background and returns what it writes as a stream,
+// closing the stream before the end cancels write
+func StreamFunc(ctx context.Context, write func(ctx context.Context, w io.Writer) error) io.ReadCloser {
+	ctx, cancel := context.WithCancel(ctx)
+	reader, writer := io.Pipe()
+	go func() {
+		defer cancel()
+		writer.CloseWithError(write(ctx, writer))
+	}()
+	return &stream{PipeReader: reader, cancel: cancel}
+}
+
+// stream is the read side of StreamFunc
+type stream struct {
+	*io.PipeReader
+	cancel context.CancelFunc
+}
+
+func (s *stream) Close() error {
+	s.cancel()
+	return s.PipeReader.Close()
+}
+
+// CleanupContext returns a context for releasing resources created under ctx,
+// it survives the cancellation of ctx but is bounded by Timeout
+func CleanupContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), Timeout)
+}
+
+// CgroupPath returns the cgroup of the process, the unified hierarchy on cgroup v2
+// and the memory controller on cgroup v1
+func CgroupPath(pid int) string {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/cgroup", pid))
+	if err != nil {
+		return ""
+	}
+	var path string
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		fields := strings.SplitN(line, ":", 3)
+		if len(fields) != 3 {
+			continue
+		}
+		if fields[1] == "" {
+			path = fields[2]
+		}
+		for _, controller := range strings.Split(fields[1], ",") {
+			if controller == "memory" {
+				return fields[2]
+			}
+		}
+	}
+	return path
+}
+
+// CgroupVersion returns "2" when the host mounts the unified cgroup hierarchy, "1" otherwise
+func CgroupVersion() string {
+	if _, err := os.Stat(HostPath("/sys/fs/cgroup/cgroup.controllers")); err == nil {
+		return "2"
+	}
+	return "1"
+}